@@ -63,10 +63,10 @@ func LaunchDownload(box *ui.Box, button *ui.Button, stop *ui.Button, opt Opts) {
 			button.Enable()
 			stop.Disable()
 		})
-		fmt.Println("Finish batch")
+		Logger.Info("batch download finished")
 
 	}
-	fmt.Println("Finish")
+	Logger.Debug("download finished", "type", opt.Dtype)
 }
 
 ///////////////
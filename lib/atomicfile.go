@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeFileAtomic writes content to a temporary file in the same directory as
+// path, fsyncs it and renames it over path. An interrupted write leaves at most
+// a hidden .tmp file behind, never a truncated path. Cancelling ctx stops the
+// copy and removes the temporary file.
+func writeFileAtomic(ctx context.Context, path string, content io.Reader, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := createTemp(dir, filepath.Base(path), perm)
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := io.Copy(tmp, &ctxReader{ctx, content}); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("error syncing file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+	committed = true
+
+	syncDir(dir)
+	return nil
+}
+
+// createTemp creates a new hidden file for name in dir. Unlike os.CreateTemp
+// it creates it with perm, so the umask applies as with os.WriteFile.
+func createTemp(dir, name string, perm os.FileMode) (*os.File, error) {
+	for try := 0; ; try++ {
+		path := filepath.Join(dir, "."+name+"."+strconv.FormatUint(uint64(rand.Uint32()), 10)+".tmp")
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && try < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// syncDir makes the rename durable. Not every platform can fsync a directory
+// (Windows can't open one for writing), so failures are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
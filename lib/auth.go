@@ -3,6 +3,8 @@
 package lib
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -36,12 +38,15 @@ func (a *Authenticator) Login() error {
 func (a *Authenticator) tryLoadCookies() bool {
 	cookies, err := a.loadCookiesFromFile()
 	if err != nil {
+		if !os.IsNotExist(err) {
+			a.config.logger().Warn("ignoring unreadable cookies", "file", cookieFile, "error", err)
+		}
 		return false
 	}
 
 	a.scraper.SetCookies(cookies)
 	if a.scraper.IsLoggedIn() {
-		fmt.Println("Logged in using saved cookies")
+		a.config.logger().Info("logged in using saved cookies", "file", cookieFile)
 		return true
 	}
 	return false
@@ -73,7 +78,7 @@ func (a *Authenticator) performLogin() error {
 		}
 
 		if !a.scraper.IsLoggedIn() {
-			fmt.Println("Bad user/pass")
+			a.config.logger().Warn("login failed: bad user/pass", "username", credentials.username)
 			continue
 		}
 
@@ -81,7 +86,7 @@ func (a *Authenticator) performLogin() error {
 			return err
 		}
 
-		fmt.Println("Logged in successfully")
+		a.config.logger().Info("logged in", "username", credentials.username)
 		return nil
 	}
 }
@@ -92,10 +97,11 @@ type credentials struct {
 
 func (a *Authenticator) getCredentials() (credentials, error) {
 	var cred credentials
-	fmt.Print("username: ")
+	out := a.config.stdout()
+	fmt.Fprint(out, "username: ")
 	fmt.Scanln(&cred.username)
 
-	fmt.Print("password: ")
+	fmt.Fprint(out, "password: ")
 	if a.config.Loginp != "" {
 		fmt.Scanln(&cred.password)
 	} else {
@@ -103,14 +109,14 @@ func (a *Authenticator) getCredentials() (credentials, error) {
 		if err != nil {
 			return credentials{}, err
 		}
-		fmt.Println()
+		fmt.Fprintln(out)
 		cred.password = string(password)
 	}
 
 	if a.config.Twofa {
-		fmt.Print("two-factor: ")
+		fmt.Fprint(out, "two-factor: ")
 		fmt.Scanln(&cred.code)
-		fmt.Println()
+		fmt.Fprintln(out)
 	}
 
 	return cred, nil
@@ -123,5 +129,5 @@ func (a *Authenticator) saveCookies() error {
 		return err
 	}
 
-	return os.WriteFile(cookieFile, js, 0666)
+	return writeFileAtomic(context.Background(), cookieFile, bytes.NewReader(js), 0666)
 }
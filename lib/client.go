@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Client is the entry point for using twmd from Go code. It holds one scraper
+// session, so requests made through it share cookies, proxy and pacing.
+// Downloads run one at a time; concurrent calls wait for each other.
+//
+//	client, err := lib.NewClient(lib.WithRequestDelay(time.Second))
+//	res, err := client.DownloadUser(ctx, "Spraytrains", lib.DownloadOptions{OutputDir: "media"})
+type Client struct {
+	mu         sync.Mutex
+	cfg        Config
+	httpClient HTTPClient
+	cookies    []*http.Cookie
+	runner     *ScrapeRunner
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithProxy sends all requests through proxyURL
+// (http|https|socks5://[user:pass@]host:port).
+func WithProxy(proxyURL string) Option {
+	return func(c *Client) { c.cfg.Proxy = proxyURL }
+}
+
+// WithProxyPool rotates between proxies, see the -proxy-file flag. strategy
+// is ProxyRoundRobin or ProxyLRU; failing proxies are left out for cooldown.
+func WithProxyPool(proxies []string, strategy string, cooldown time.Duration) Option {
+	return func(c *Client) {
+		c.cfg.ProxyList = proxies
+		c.cfg.ProxyStrategy = strategy
+		c.cfg.ProxyCooldown = cooldown
+	}
+}
+
+// WithTransport sets the timeouts of media transfers.
+func WithTransport(opts TransportOptions) Option {
+	return func(c *Client) { c.cfg.Transport = opts }
+}
+
+// WithRequestDelay sets the minimum delay between scraper requests.
+func WithRequestDelay(delay time.Duration) Option {
+	return func(c *Client) { c.cfg.RequestDelay = delay }
+}
+
+// WithRateLimit caps the combined download rate in bytes per second. The
+// schedule, if any, overrides rate at certain times of day.
+func WithRateLimit(rate int64, schedule []RateWindow) Option {
+	return func(c *Client) {
+		c.cfg.LimitRate = rate
+		c.cfg.LimitSchedule = schedule
+	}
+}
+
+// WithHTTPClient replaces the client used for media transfers.
+func WithHTTPClient(httpClient HTTPClient) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithCookies logs the scraper session in with cookies of a previous login,
+// e.g. the content of twmd_cookies.json. Needed for NSFW tweets.
+func WithCookies(cookies []*http.Cookie) Option {
+	return func(c *Client) { c.cookies = cookies }
+}
+
+// WithLogger sets where the client logs rate limits, proxy switches and
+// failures; with -v level detail at slog.LevelDebug. Nothing is logged by
+// default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) { c.cfg.Logger = logger }
+}
+
+func NewClient(opts ...Option) (*Client, error) {
+	c := &Client{
+		cfg: Config{
+			Size:          "large",
+			ProxyStrategy: ProxyRoundRobin,
+			ProxyCooldown: time.Minute,
+			Transport:     DefaultTransportOptions,
+		},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if c.httpClient == nil {
+		var err error
+		if len(c.cfg.ProxyList) > 0 {
+			c.httpClient, err = NewProxyPool(c.cfg.ProxyList, c.cfg.ProxyStrategy, c.cfg.ProxyCooldown, c.cfg.Transport)
+		} else {
+			c.httpClient, err = NewHTTPClient(c.cfg.Proxy, c.cfg.Transport)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	runner, err := NewScraper(&c.cfg, c.httpClient)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.cookies) > 0 {
+		runner.scraper.SetCookies(c.cookies)
+	}
+	c.runner = runner
+	return c, nil
+}
+
+// DownloadOptions selects what a download saves and where.
+type DownloadOptions struct {
+	// OutputDir is the base directory. A user's media go to
+	// OutputDir/<handle>/img and OutputDir/<handle>/video, a single tweet's
+	// to OutputDir/img and OutputDir/video, unless OutputTemplate says
+	// otherwise.
+	OutputDir string
+	// OutputTemplate places the media within OutputDir, see
+	// ParseOutputTemplate. DefaultOutputTemplate if empty.
+	OutputTemplate string
+	// Images and Videos select the media types; leaving both false selects
+	// both.
+	Images bool
+	Videos bool
+	// MaxTweets is how many timeline tweets DownloadUser scans, 100 if 0.
+	MaxTweets   int
+	Retweets    bool
+	RetweetOnly bool
+	// Size of images: small, normal or large (the default).
+	Size string
+	// Update skips media whose file exists already.
+	Update     bool
+	FileFormat string
+	DateFormat string
+	// SkipSimilar skips images within SimilarThreshold bits of an image
+	// downloaded before, see HammingDistance.
+	SkipSimilar      bool
+	SimilarThreshold int
+	// WriteInfoJSON saves the tweet record as JSON next to every media file
+	// (InfoJSONMedia) or once per tweet (InfoJSONTweet), see TweetInfo.
+	WriteInfoJSON string
+	// EmbedMetadata writes the tweet's author, text, URL, date and hashtags
+	// into saved images, see EmbedImageMetadata.
+	EmbedMetadata bool
+	// EmbedVideoMetadata writes the tweet's title, author, date, URL and text
+	// into saved MP4 videos, see EmbedVideoMetadata.
+	EmbedVideoMetadata bool
+	// SetMtime dates saved files to their tweet and folders to their newest
+	// tweet.
+	SetMtime bool
+	// OnEvent, if set, is called for every Event of the download, from the
+	// goroutine doing the work.
+	OnEvent func(Event)
+}
+
+// Result is the outcome of a download call.
+type Result struct {
+	Summary
+	Media []MediaResult
+}
+
+// DownloadUser downloads the media of the latest tweets of handle. An
+// interrupted crawl is resumed by the next call for the same handle and
+// OutputDir, see RunUserTweets. The result is returned even with an error,
+// as some media may have been saved.
+func (c *Client) DownloadUser(ctx context.Context, handle string, opts DownloadOptions) (Result, error) {
+	return c.download(ctx, opts, func(cfg *Config) { cfg.User = handle })
+}
+
+// DownloadTweet downloads the media of one tweet.
+func (c *Client) DownloadTweet(ctx context.Context, id string, opts DownloadOptions) (Result, error) {
+	return c.download(ctx, opts, func(cfg *Config) { cfg.TweetID = id })
+}
+
+func (c *Client) download(ctx context.Context, opts DownloadOptions, target func(*Config)) (Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg := c.cfg
+	target(&cfg)
+	cfg.OutputBase = opts.OutputDir
+	cfg.OutputDir = filepath.Join(opts.OutputDir, cfg.User)
+	cfg.OutputTemplate = opts.OutputTemplate
+	cfg.Images, cfg.Videos = opts.Images, opts.Videos
+	if !cfg.Images && !cfg.Videos {
+		cfg.Images, cfg.Videos = true, true
+	}
+	cfg.NumberOfTweets = opts.MaxTweets
+	if cfg.NumberOfTweets == 0 {
+		cfg.NumberOfTweets = 100
+	}
+	cfg.Retweets, cfg.RetweetOnly = opts.Retweets, opts.RetweetOnly
+	if opts.Size != "" {
+		cfg.Size = opts.Size
+	}
+	cfg.Update = opts.Update
+	cfg.Format, cfg.Datefmt = opts.FileFormat, opts.DateFormat
+	cfg.SkipSimilar, cfg.SimilarDist = opts.SkipSimilar, opts.SimilarThreshold
+	cfg.WriteInfoJSON = opts.WriteInfoJSON
+	cfg.EmbedMetadata, cfg.EmbedVideoMeta = opts.EmbedMetadata, opts.EmbedVideoMetadata
+	cfg.SetMtime = opts.SetMtime
+	if err := cfg.Validate(); err != nil {
+		return Result{}, err
+	}
+	// The hash index and the failure journal live in OutputDir, wherever the
+	// output template puts the media.
+	if err := os.MkdirAll(cfg.OutputDir, os.ModePerm); err != nil {
+		return Result{}, fmt.Errorf("error creating directory: %w", err)
+	}
+
+	d := NewDownloader(&cfg, c.httpClient)
+	d.progress.SetOutput(func(string) {})
+	if opts.OnEvent != nil {
+		d.AddHook(opts.OnEvent)
+	}
+	c.runner.cfg = &cfg
+	c.runner.downloader = d
+
+	err := c.runner.Run(ctx, ctx)
+	return Result{Summary: d.summary(), Media: d.mediaResults()}, err
+}
@@ -1,11 +1,15 @@
 package lib
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
+	"time"
 )
 
 var version = "1.13.3"
@@ -20,6 +24,9 @@ type Config struct {
 	Videos         bool   `default:"false"`
 	Images         bool   `default:"false"`
 	UrlOnly        bool   `default:"false"`
+	DryRun         bool   `default:"false"`
+	JSON           bool   `default:"false"`
+	NoProgress     bool   `default:"false"`
 	Retweets       bool   `default:"false"`
 	RetweetOnly    bool   `default:"false"`
 	Size           string `default:"orig"`
@@ -30,8 +37,107 @@ type Config struct {
 	Loginp         string `default:"false"`
 	Twofa          bool   `default:"false"`
 	Proxy          string `default:""`
+	SkipSimilar    bool   `default:"false"`
+	SimilarDist    int    `default:"10"`
+	LimitRate      int64  `default:"0"`
+	Exec           string `default:""`
+	ExecAfterRun   string `default:""`
+	Verbose        bool   `default:"false"`
+	Quiet          bool   `default:"false"`
+	LogFormat      string `default:"text"`
+	LogFile        string `default:""`
+	WriteInfoJSON  string `default:""`
+	EmbedMetadata  bool   `default:"false"`
+	EmbedVideoMeta bool   `default:"false"`
+	SetMtime       bool   `default:"false"`
+	OutputTemplate string `default:"{USER}/{TYPE}/{FILENAME}"`
 	Nologo         bool   `default:"false"`
 	Printversion   bool   `default:"false"`
+
+	LimitSchedule []RateWindow
+	RequestDelay  time.Duration
+	ProxyList     []string
+	ProxyStrategy string
+	ProxyCooldown time.Duration
+	Transport     TransportOptions
+	Logger        *slog.Logger
+	// Stdout receives the text output: URLs, dry-run plans and downloaded
+	// files. It defaults to os.Stdout.
+	Stdout io.Writer
+	// OutputBase is the directory OutputTemplate is relative to; OutputDir
+	// is then the user folder within it, holding twmd's own files.
+	OutputBase string
+}
+
+// ConfigError reports an invalid setting of a Config.
+type ConfigError struct {
+	Field string
+	Msg   string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Msg)
+}
+
+// Validate checks the values of the settings that have a fixed set of valid
+// values. It doesn't require a user or tweet, so Config can be filled in by
+// the caller piece by piece.
+func (cfg *Config) Validate() error {
+	if cfg.Format != "" {
+		if _, err := ParseFileFormat(cfg.Format); err != nil {
+			return &ConfigError{"file-format", err.Error()}
+		}
+	}
+
+	if cfg.Proxy != "" {
+		if _, err := ParseProxyURL(cfg.Proxy); err != nil {
+			return &ConfigError{"proxy", err.Error()}
+		}
+	}
+	for _, proxy := range cfg.ProxyList {
+		if _, err := ParseProxyURL(proxy); err != nil {
+			return &ConfigError{"proxy-file", err.Error()}
+		}
+	}
+
+	if cfg.ProxyStrategy != ProxyRoundRobin && cfg.ProxyStrategy != ProxyLRU {
+		return &ConfigError{"proxy-strategy", "Must be one of rr, lru"}
+	}
+
+	if cfg.SimilarDist < 0 || cfg.SimilarDist > 64 {
+		return &ConfigError{"similar-threshold", "Must be between 0 and 64"}
+	}
+
+	re := regexp.MustCompile("small|normal|large")
+	if !re.MatchString(cfg.Size) {
+		return &ConfigError{"size", "Must be one of small, normal, large"}
+	}
+
+	if cfg.LogFormat != "" && cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return &ConfigError{"log-format", "Must be one of text, json"}
+	}
+
+	if cfg.OutputTemplate != "" {
+		if _, err := ParseOutputTemplate(cfg.OutputTemplate); err != nil {
+			return &ConfigError{"output-template", err.Error()}
+		}
+	}
+
+	if cfg.WriteInfoJSON != "" && cfg.WriteInfoJSON != InfoJSONMedia && cfg.WriteInfoJSON != InfoJSONTweet {
+		return &ConfigError{"write-info-json", "Must be one of media, tweet"}
+	}
+
+	if cfg.Exec != "" {
+		if _, err := SplitCommand(cfg.Exec); err != nil {
+			return &ConfigError{"exec", err.Error()}
+		}
+	}
+	if cfg.ExecAfterRun != "" {
+		if _, err := SplitCommand(cfg.ExecAfterRun); err != nil {
+			return &ConfigError{"exec-after-run", err.Error()}
+		}
+	}
+	return nil
 }
 
 func quitWithError(flags *flag.FlagSet, err string) {
@@ -53,29 +159,66 @@ func Configure() *Config {
 	flag.BoolVar(&videosImages, "all", false, "Download images and videos")
 	flag.BoolVar(&cfg.Retweets, "retweet", false, "Download retweet too")
 	flag.BoolVar(&cfg.UrlOnly, "url", false, "Return media URL without downloading it")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "Scrape and filter but only print what would be downloaded and where")
+	flag.BoolVar(&cfg.JSON, "json", false, "Print newline-delimited JSON events on stdout instead of text")
+	flag.BoolVar(&cfg.NoProgress, "no-progress", false, "Print one line per file instead of the live progress view")
 	flag.BoolVar(&cfg.RetweetOnly, "retweet-only", false, "Download only retweets")
 	flag.StringVar(&cfg.Size, "size", "large", "Choose size between small|normal|large (default large)")
 	flag.BoolVar(&cfg.Update, "update", false, "Download missing tweets only")
 	flag.StringVar(&cfg.OutputDir, "output", "", "Output directory")
-	flag.StringVar(&cfg.Format, "file-format", "", "Formatted name for the downloaded file, {DATE} {USERNAME} {NAME} {TITLE} {ID}")
+	flag.StringVar(&cfg.OutputTemplate, "output-template", DefaultOutputTemplate, "Where to save media within the output directory, e.g. \"{USERNAME}/{YEAR}/{MONTH}/{TYPE}/{ID}_{INDEX}.{EXT}\"")
+	flag.StringVar(&cfg.Format, "file-format", "", "Name for the downloaded file, e.g. \"{DATE:2006-01-02}_{USERNAME:lower}[_{TITLE:60}]_{INDEX}of{COUNT}\"")
 	flag.StringVar(&cfg.Datefmt, "date-format", "", "Apply custom date format. (https://go.dev/src/time/format.go)")
 	flag.StringVar(&cfg.Login, "login", "", "Login (needed for NSFW tweets)")
 	flag.StringVar(&cfg.Loginp, "login-plaintext", "", "Plain text login (needed for NSFW tweets)")
 	flag.BoolVar(&cfg.Twofa, "2fa", false, "Use 2fa")
-	flag.StringVar(&cfg.Proxy, "proxy", "", "Use proxy (proto://ip:port)")
+	flag.StringVar(&cfg.Proxy, "proxy", "", "Use proxy (http|https|socks5://[user:pass@]ip:port)")
+	var proxyFile string
+	flag.StringVar(&proxyFile, "proxy-file", "", "File with one proxy per line to rotate between")
+	flag.StringVar(&cfg.ProxyStrategy, "proxy-strategy", ProxyRoundRobin, "How to pick from -proxy-file: rr (round-robin) or lru (least recently used)")
+	flag.DurationVar(&cfg.ProxyCooldown, "proxy-cooldown", time.Minute, "How long a failing or rate limited proxy is left out before it is probed again (doubles on repeated failures)")
+	flag.DurationVar(&cfg.Transport.ConnectTimeout, "connect-timeout", DefaultTransportOptions.ConnectTimeout, "Timeout for connecting to the media CDN (TCP and TLS)")
+	flag.DurationVar(&cfg.Transport.HeaderTimeout, "header-timeout", DefaultTransportOptions.HeaderTimeout, "Timeout waiting for response headers")
+	flag.DurationVar(&cfg.Transport.IdleTimeout, "idle-timeout", DefaultTransportOptions.IdleTimeout, "How long idle connections are kept for reuse")
+	flag.DurationVar(&cfg.Transport.Timeout, "timeout", DefaultTransportOptions.Timeout, "Total time limit per file, 0 for none")
+	flag.DurationVar(&cfg.Transport.StallTimeout, "stall-timeout", DefaultTransportOptions.StallTimeout, "Abort a transfer when no data arrives for this long, 0 to disable")
+	flag.BoolVar(&cfg.SkipSimilar, "skip-similar", false, "Don't save images that are near-duplicates of already downloaded ones")
+	flag.IntVar(&cfg.SimilarDist, "similar-threshold", 10, "Maximum Hamming distance for -skip-similar (0-64)")
+	flag.DurationVar(&cfg.RequestDelay, "request-delay", 0, "Minimum delay between scraper requests, e.g. 2s (grows automatically when rate limited)")
+
+	var limitRate, limitSchedule string
+	flag.StringVar(&limitRate, "limit-rate", "", "Maximum combined download rate, e.g. 500K or 2M (bytes/s)")
+	flag.StringVar(&limitSchedule, "limit-schedule", "", "Time of day rate limits overriding -limit-rate, e.g. \"09:00-18:00=1M,18:00-09:00=0\" (0 = unlimited)")
+	flag.StringVar(&cfg.Exec, "exec", "", "Command to run after every downloaded file, e.g. \"scan {path} {tweet_id}\" (also {url}, {type})")
+	flag.StringVar(&cfg.ExecAfterRun, "exec-after-run", "", "Command to run once all downloads are done, {dir} is the output directory")
+	flag.StringVar(&cfg.WriteInfoJSON, "write-info-json", "", "Save the tweet record as JSON next to every media file (media) or once per tweet (tweet)")
+	flag.BoolVar(&cfg.EmbedMetadata, "embed-metadata", false, "Write author, text, tweet URL, date and hashtags into saved images as EXIF and XMP")
+	flag.BoolVar(&cfg.EmbedVideoMeta, "embed-video-metadata", false, "Write title, author, date, tweet URL and text into saved MP4 videos")
+	flag.BoolVar(&cfg.SetMtime, "set-mtime", false, "Set the modification time of saved files to the tweet date, and of folders to their newest tweet")
+	addLogFlags(flag.CommandLine, cfg)
 	flag.BoolVar(&cfg.Printversion, "version", false, "Print version and exit")
 
 	// Custom usage message
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "twmd: Apiless twitter media downloader\n\nUsage:\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  twmd similar [-threshold N] DIR    Group near-duplicate images in a user folder\n")
+		fmt.Fprintf(os.Stderr, "  twmd retry-failed DIR              Retry the media listed in DIR/%s\n", failedJournalFile)
+		fmt.Fprintf(os.Stderr, "  twmd gallery DIR                   Write a static HTML gallery of a user folder\n")
+		fmt.Fprintf(os.Stderr, "  twmd export -user USER [-format jsonl|csv]  Write the user's tweets with their media paths\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  twmd -u Spraytrains -o ~/Downloads -a -r -n 300\n")
 		fmt.Fprintf(os.Stderr, "  twmd -u Spraytrains -o ~/Downloads -R -U -n 300\n")
+		fmt.Fprintf(os.Stderr, "  twmd -user Spraytrains -output ~/Downloads -all -file-format \"{DATE} {ID}\" -dry-run\n")
 		fmt.Fprintf(os.Stderr, "  twmd --proxy socks5://127.0.0.1:9050 -t 156170319961391104\n")
+		fmt.Fprintf(os.Stderr, "  twmd -u Spraytrains -a -proxy-file proxies.txt -proxy-strategy lru\n")
 		fmt.Fprintf(os.Stderr, "  twmd -t 156170319961391104\n")
 		fmt.Fprintf(os.Stderr, "  twmd -t 156170319961391104 -f \"{DATE} {ID}\"\n")
 		fmt.Fprintf(os.Stderr, "  twmd -t 156170319961391104 -f \"{DATE} {ID}\" -d \"2006-01-02_15-04-05\"\n")
+		fmt.Fprintf(os.Stderr, "  twmd -u Spraytrains -a -limit-rate 2M -limit-schedule \"18:00-08:00=0\"\n")
+		fmt.Fprintf(os.Stderr, "  twmd -user Spraytrains -all -exec \"convert {path} -thumbnail 200x200 {path}.thumb.jpg\"\n")
+		fmt.Fprintf(os.Stderr, "  twmd similar -threshold 6 ~/Downloads/Spraytrains\n")
 	}
 
 	flag.Parse()
@@ -98,20 +241,29 @@ func Configure() *Config {
 		quitWithError(flag.CommandLine, "You must specify what to download. (-img) for images, (-video) for videos or (-all) for both")
 	}
 
-	var re = regexp.MustCompile(`{ID}|{DATE}|{NAME}|{USERNAME}|{TITLE}`)
-	if cfg.Format != "" && !re.MatchString(cfg.Format) {
-		quitWithError(flag.CommandLine, "Invalid format specified. Must include at least one of {ID}, {DATE}, {NAME}, {USERNAME}, or {TITLE}")
-		flag.Usage()
-		os.Exit(1)
-	}
+	parseTransferFlags(flag.CommandLine, cfg, proxyFile, limitRate, limitSchedule)
 
-	re = regexp.MustCompile("small|normal|large")
-	if !re.MatchString(cfg.Size) {
-		quitWithError(flag.CommandLine, "Error in size: Must be one of small, normal, large")
-		os.Exit(1)
+	if err := cfg.Validate(); err != nil {
+		var cerr *ConfigError
+		if errors.As(err, &cerr) {
+			quitWithError(flag.CommandLine, "Error in "+cerr.Field+": "+cerr.Msg)
+		}
+		quitWithError(flag.CommandLine, err.Error())
 	}
 
+	cfg.OutputBase = cfg.OutputDir
 	cfg.OutputDir = filepath.Join(cfg.OutputDir, cfg.User)
+	if cfg.DryRun {
+		return cfg
+	}
+
+	// The hash index and the failure journal live in OutputDir, wherever the
+	// output template puts the media.
+	os.MkdirAll(cfg.OutputDir, os.ModePerm)
+	if cfg.OutputTemplate != DefaultOutputTemplate {
+		return cfg
+	}
+
 	if cfg.Videos {
 		os.MkdirAll(filepath.Join(cfg.OutputDir, "video"), os.ModePerm)
 	}
@@ -122,3 +274,37 @@ func Configure() *Config {
 
 	return cfg
 }
+
+// parseTransferFlags fills in the proxy list and the bandwidth limits of cfg
+// from the -proxy-file, -limit-rate and -limit-schedule flags of flags.
+func parseTransferFlags(flags *flag.FlagSet, cfg *Config, proxyFile, limitRate, limitSchedule string) {
+	if proxyFile != "" {
+		proxies, err := LoadProxyFile(proxyFile)
+		if err != nil {
+			quitWithError(flags, "Error in proxy-file: "+err.Error())
+		}
+		if len(proxies) == 0 {
+			quitWithError(flags, "Error in proxy-file: no proxies in "+proxyFile)
+		}
+		if cfg.Proxy != "" {
+			proxies = append([]string{cfg.Proxy}, proxies...)
+		}
+		cfg.ProxyList = proxies
+	}
+
+	if limitRate != "" {
+		rate, err := ParseRate(limitRate)
+		if err != nil {
+			quitWithError(flags, "Error in limit-rate: "+err.Error())
+		}
+		cfg.LimitRate = rate
+	}
+
+	if limitSchedule != "" {
+		schedule, err := ParseRateSchedule(limitSchedule)
+		if err != nil {
+			quitWithError(flags, "Error in limit-schedule: "+err.Error())
+		}
+		cfg.LimitSchedule = schedule
+	}
+}
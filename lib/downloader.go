@@ -1,14 +1,21 @@
 package lib
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"image"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	twitterscraper "github.com/imperatrona/twitter-scraper"
 )
@@ -16,149 +23,429 @@ import (
 type Downloader struct {
 	config     *Config
 	httpClient HTTPClient
+	limiter    *BandwidthLimiter
+	progress   *Progress
+
+	hashesOnce sync.Once
+	hashes     *HashIndex
+
+	planned  atomic.Int64
+	existing atomic.Int64
+
+	resultsMu sync.Mutex
+	results   []MediaResult
+
+	hooks      []func(Event)
+	template   *OutputTemplate
+	fileFormat *Template
+
+	dirsMu sync.Mutex
+	dirs   map[string]bool
 }
 
 func NewDownloader(cfg *Config, httpClient HTTPClient) *Downloader {
-	return &Downloader{
+	d := &Downloader{
 		httpClient: httpClient,
 		config:     cfg,
+		progress:   NewProgress(cfg.stdout()),
+	}
+	if cfg.LimitRate > 0 || len(cfg.LimitSchedule) > 0 {
+		d.limiter = NewBandwidthLimiter(cfg.LimitRate, cfg.LimitSchedule)
 	}
+	// Validated by Config.Validate.
+	d.template, _ = ParseOutputTemplate(DefaultOutputTemplate)
+	if cfg.OutputTemplate != "" {
+		d.template, _ = ParseOutputTemplate(cfg.OutputTemplate)
+	}
+	if cfg.Format != "" {
+		d.fileFormat, _ = ParseFileFormat(cfg.Format)
+	}
+	if cfg.Exec != "" {
+		command, _ := SplitCommand(cfg.Exec)
+		d.AddHook(d.execHook(command))
+	}
+	return d
 }
 
-func (d *Downloader) downloadVideos(tweet *twitterscraper.Tweet) error {
-	wg := sync.WaitGroup{}
-	for _, video := range tweet.Videos {
-		wg.Add(1)
-		go func(v twitterscraper.Video) {
-			defer wg.Done()
-			url := strings.Split(v.URL, "?")[0]
-			d.download(tweet, url, "video", d.config.OutputDir, "user")
-		}(video)
-	}
-	wg.Wait()
-	return nil
+func (d *Downloader) downloadVideos(ctx context.Context, tweet *twitterscraper.Tweet) []MediaResult {
+	return d.downloadMedia(ctx, tweet, "video")
+}
+
+func (d *Downloader) downloadPhotos(ctx context.Context, tweet *twitterscraper.Tweet) []MediaResult {
+	return d.downloadMedia(ctx, tweet, "img")
 }
 
-func (d *Downloader) downloadPhotos(tweet *twitterscraper.Tweet) error {
+// downloadMedia downloads the media files of tweet of one type concurrently.
+func (d *Downloader) downloadMedia(ctx context.Context, tweet *twitterscraper.Tweet, fileType string) []MediaResult {
+	var files []tweetMediaFile
+	for _, f := range tweetMedia(tweet, d.config.Size) {
+		if f.fileType == fileType {
+			files = append(files, f)
+		}
+	}
+
+	results := make([]MediaResult, len(files))
 	var wg sync.WaitGroup
-	for _, photo := range tweet.Photos {
+	d.progress.Enqueue(len(files))
+	for i, f := range files {
 		wg.Add(1)
-		go func(p twitterscraper.Photo) {
+		go func(i int, f tweetMediaFile) {
 			defer wg.Done()
-			if !strings.Contains(p.URL, "video_thumb/") {
-				url := p.URL
-				if d.config.Size == "orig" || d.config.Size == "small" {
-					url += "?name=" + d.config.Size
-				}
-				d.download(tweet, url, "img", d.config.OutputDir, "user")
-			}
-		}(photo)
+			results[i] = d.download(ctx, tweet, f)
+		}(i, f)
 	}
 	wg.Wait()
-	return nil
+	return results
+}
+
+// tweetMediaFile is a media file of a tweet and the URL it is downloaded
+// from.
+type tweetMediaFile struct {
+	index    int
+	count    int
+	id       string
+	url      string
+	fileType string
+}
+
+// tweetMedia lists the media files of tweet, videos then photos, numbered
+// from 1. Video thumbnails are left out.
+func tweetMedia(tweet *twitterscraper.Tweet, size string) []tweetMediaFile {
+	var files []tweetMediaFile
+	for _, v := range tweet.Videos {
+		files = append(files, tweetMediaFile{index: len(files) + 1, id: v.ID, url: strings.Split(v.URL, "?")[0], fileType: "video"})
+	}
+	for _, p := range tweet.Photos {
+		if strings.Contains(p.URL, "video_thumb/") {
+			continue
+		}
+		url := p.URL
+		if size == "orig" || size == "small" {
+			url += "?name=" + size
+		}
+		files = append(files, tweetMediaFile{index: len(files) + 1, id: p.ID, url: url, fileType: "img"})
+	}
+	for i := range files {
+		files[i].count = len(files)
+	}
+	return files
 }
 
-func (d *Downloader) download(tweet *twitterscraper.Tweet, url, fileType, output, dwnType string) error {
-	name := d.generateFileName(tweet, url)
+// download handles the media file f of tweet.
+func (d *Downloader) download(ctx context.Context, tweet *twitterscraper.Tweet, f tweetMediaFile) MediaResult {
+	defer d.progress.Dequeue()
+	index, url, fileType := f.index, f.url, f.fileType
+	name := d.generateFileName(tweet, f)
+	result := MediaResult{TweetID: tweet.ID, Username: tweet.Username, URL: url, Name: name, Type: fileType, Index: index}
+	result.Width, result.Height = videoSize(url)
 
 	if d.config.UrlOnly {
-		fmt.Println(url)
-		return nil
+		if !d.config.JSON {
+			fmt.Fprintln(d.config.stdout(), url)
+		}
+		d.record(ctx, result)
+		return result
+	}
+
+	filePath, err := d.determineFilePath(tweet, f, name)
+	result.Path = filePath
+	if d.config.DryRun {
+		if !d.config.JSON {
+			d.printPlan(tweet, url, filePath, err != nil)
+		}
+		if err != nil {
+			result.Status, result.Err = MediaSkipped, err
+		}
+		d.record(ctx, result)
+		return result
 	}
 
-	resp, err := d.makeRequest(url)
 	if err != nil {
-		return err
+		d.progress.Skip()
+		result.Status, result.Err = MediaSkipped, err
+		d.record(ctx, result)
+		return result
 	}
-	defer resp.Body.Close()
+	item := mediaItem{tweetID: tweet.ID, username: tweet.Username, index: index, url: url, name: name, fileType: fileType, path: filePath,
+		posted: time.Unix(tweet.Timestamp, 0)}
+	if (d.config.EmbedMetadata && fileType == "img") || (d.config.EmbedVideoMeta && fileType == "video") {
+		item.meta = newMediaMetadata(tweet)
+	}
+	return d.fetch(ctx, item)
+}
+
+// mediaItem is one media file to transfer and where to save it.
+type mediaItem struct {
+	tweetID  string
+	username string
+	index    int
+	url      string
+	name     string
+	fileType string
+	path     string
+	posted   time.Time
+	// meta is embedded into images with -embed-metadata and into MP4 videos
+	// with -embed-video-metadata.
+	meta *MediaMetadata
+}
+
+// fetch transfers one media file to its path and records the result.
+// Cancelling ctx aborts the transfer without leaving a partial file.
+func (d *Downloader) fetch(ctx context.Context, item mediaItem) (result MediaResult) {
+	result = MediaResult{TweetID: item.tweetID, Username: item.username, Index: item.index, URL: item.url,
+		Name: item.name, Type: item.fileType, Path: item.path}
+	result.Width, result.Height = videoSize(item.url)
+	d.emit(Event{Type: EventMediaStarted, Media: &result, ctx: ctx})
+	transfer := d.progress.Start(item.name)
+	var err error
+	defer func() {
+		if result.Status != MediaSkipped {
+			transfer.Finish(err)
+		}
+		if err != nil {
+			result.Status, result.Err = MediaFailed, err
+		}
+		d.record(ctx, result)
+	}()
 
-	filePath, err := d.determineFilePath(output, fileType, name, dwnType)
+	d.log().Debug("requesting media", "tweet_id", item.tweetID, "url", item.url, "path", item.path)
+	resp, err := d.makeRequest(ctx, item.url)
 	if err != nil {
-		return err
+		return
+	}
+	defer resp.Body.Close()
+	transfer.SetSize(resp.ContentLength)
+
+	var content io.Reader = resp.Body
+	if d.limiter != nil {
+		content = d.limiter.Reader(ctx, content)
+	}
+	content = transfer.Reader(content)
+
+	var hash uint64
+	var hashed bool
+	if item.fileType == "img" {
+		var data []byte
+		if data, err = io.ReadAll(content); err != nil {
+			err = fmt.Errorf("error reading image: %w", err)
+			return
+		}
+		content = bytes.NewReader(data)
+		if conf, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			result.Width, result.Height = conf.Width, conf.Height
+		}
+
+		var herr error
+		hash, herr = HashImage(bytes.NewReader(data))
+		hashed = herr == nil
+		if hashed && d.config.SkipSimilar {
+			similar, ok := d.hashIndex().MatchOrReserve(filepath.Base(item.path), hash, d.config.SimilarDist)
+			if ok {
+				result.Status = MediaSkipped
+				result.Err = fmt.Errorf("similar to %s: %w", similar, ErrAlreadyExists)
+				transfer.Skip()
+				d.log().Info("skipped near-duplicate image", "tweet_id", item.tweetID, "url", item.url, "similar_to", similar)
+				return
+			}
+			// Add takes over the reservation once the file is saved.
+			defer d.hashIndex().Release(filepath.Base(item.path))
+		}
+	}
+
+	if err = d.saveFile(ctx, item.path, content, item.meta); err != nil {
+		return
+	}
+	if d.config.SetMtime {
+		d.setMtime(item.path, item.posted)
+	}
+	result.Status = MediaDownloaded
+	result.Bytes = transfer.Bytes()
+	if hashed {
+		result.Hash = hash
 	}
 
-	if err := d.saveFile(filePath, resp.Body); err != nil {
-		return err
+	if hashed {
+		if err := d.hashIndex().Add(filepath.Base(item.path), hash); err != nil {
+			d.log().Error("writing hash index failed", "file", hashIndexFile, "error", err)
+		}
 	}
 
-	fmt.Println("Downloaded " + name)
-	return nil
+	d.progress.Println("Downloaded " + item.name)
+	return
 }
 
-func (d *Downloader) generateFileName(tweet *twitterscraper.Tweet, url string) string {
-	segments := strings.Split(url, "/")
-	name := segments[len(segments)-1]
+// printPlan reports what a real run would do with one media file.
+func (d *Downloader) printPlan(tweet *twitterscraper.Tweet, url, filePath string, exists bool) {
+	d.planned.Add(1)
+	action := "download"
+	if exists {
+		d.existing.Add(1)
+		action = "skip (exists)"
+	}
+	fmt.Fprintf(d.config.stdout(), "%s\t%s\t%s\t%s\n", tweet.ID, url, filePath, action)
+}
 
-	re := regexp.MustCompile(`name=`)
-	if re.MatchString(name) {
-		segments = strings.Split(name, "?")
-		name = segments[len(segments)-2]
+func (d *Downloader) printPlanTotals() {
+	planned, existing := d.planned.Load(), d.existing.Load()
+	fmt.Fprintf(d.config.stdout(), "Dry run: %d tweets scanned, %d media planned: %d to download, %d skipped as existing\n",
+		d.progress.Snapshot().Tweets, planned, planned-existing, existing)
+}
+
+func (d *Downloader) log() *slog.Logger {
+	if d.config.User != "" {
+		return d.config.logger().With("user", d.config.User)
 	}
+	return d.config.logger()
+}
+
+func (d *Downloader) hashIndex() *HashIndex {
+	d.hashesOnce.Do(func() {
+		path := filepath.Join(d.config.OutputDir, hashIndexFile)
+		idx, err := LoadHashIndex(path)
+		if err != nil {
+			d.log().Error("reading hash index failed", "file", hashIndexFile, "error", err)
+			idx = &HashIndex{path: path, hashes: make(map[string]uint64)}
+		}
+		d.hashes = idx
+	})
+	return d.hashes
+}
 
-	if d.config.Format != "" {
-		nameFormat, _ := FormatFileName(tweet, d.config.Format, d.config.Datefmt)
-		name = nameFormat + "_" + name
+var videoSizeRe = regexp.MustCompile(`/(\d+)x(\d+)/`)
+
+// videoSize reads the dimensions of a video from its URL, which holds them as
+// in .../vid/1280x720/name.mp4. It returns zeros for other URLs.
+func videoSize(url string) (width, height int) {
+	m := videoSizeRe.FindStringSubmatch(url)
+	if m == nil {
+		return 0, 0
 	}
+	width, _ = strconv.Atoi(m[1])
+	height, _ = strconv.Atoi(m[2])
+	return width, height
+}
 
-	return name
+// generateFileName names the media file f of tweet after -file-format: the
+// formatted name if it has {EXT}, else the formatted name followed by the
+// name of the file on the CDN.
+func (d *Downloader) generateFileName(tweet *twitterscraper.Tweet, f tweetMediaFile) string {
+	file := &mediaFile{tweetMediaFile: f, tweet: tweet, datefmt: d.config.Datefmt}
+	name := file.cdnName()
+	if d.fileFormat == nil {
+		return name
+	}
+	formatted := formatFileName(d.fileFormat, file)
+	if d.fileFormat.Uses("EXT") {
+		return formatted
+	}
+	return formatted + "_" + name
 }
 
-func (d *Downloader) makeRequest(url string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func (d *Downloader) makeRequest(ctx context.Context, url string) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
 	req.Header.Add("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
 
 	resp, err := d.httpClient.Do(req)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("error downloading: %w", err)
 	}
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("error: status code %d", resp.StatusCode)
+		resp.Body.Close()
+		cancel()
+		return nil, &StatusError{Code: resp.StatusCode}
 	}
 
+	if stall := d.config.Transport.StallTimeout; stall > 0 {
+		resp.Body = newStallReader(resp.Body, stall, cancel)
+	} else {
+		resp.Body = &cancelOnClose{resp.Body, cancel}
+	}
 	return resp, nil
 }
 
-func (d *Downloader) determineFilePath(output, fileType, name, dwnType string) (string, error) {
-	var filePath string
-	if dwnType == "user" {
-		filePath = filepath.Join(output, fileType, name)
-		if d.config.Update {
-			if _, err := os.Stat(filePath); !os.IsNotExist(err) {
-				return "", fmt.Errorf("%s: already exists", name)
-			}
-		}
-		if fileType == "rtimg" || fileType == "rtvideo" {
-			filePath = filepath.Join(output, strings.TrimPrefix(fileType, "rt"), "RE-"+name)
-		}
-	} else {
-		filePath = filepath.Join(output, name)
-		if d.config.Update {
-			if _, err := os.Stat(filePath); !os.IsNotExist(err) {
-				return "", fmt.Errorf("file exists")
-			}
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// determineFilePath returns where the media file f of tweet, named name by
+// generateFileName, should be saved according to the output template.
+// With -update it also returns ErrAlreadyExists if that file exists already;
+// the path is still set.
+func (d *Downloader) determineFilePath(tweet *twitterscraper.Tweet, f tweetMediaFile, name string) (string, error) {
+	base, user := d.config.OutputBase, d.config.User
+	if base == "" {
+		// Without a base, OutputDir is the user folder itself.
+		base, user = d.config.OutputDir, ""
+	}
+	file := &mediaFile{tweetMediaFile: f, tweet: tweet, user: user, filename: name, datefmt: d.config.Datefmt}
+	filePath := filepath.Join(base, filepath.FromSlash(d.template.Expand(file)))
+
+	if d.config.Update {
+		if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+			return filePath, fmt.Errorf("%s: %w", filepath.Base(filePath), ErrAlreadyExists)
 		}
 	}
 	return filePath, nil
 }
 
-func (d *Downloader) saveFile(filePath string, content io.Reader) error {
+// saveFile writes content to filePath. With meta, it is embedded into the
+// image or MP4 video content; if that fails the file is saved as is.
+func (d *Downloader) saveFile(ctx context.Context, filePath string, content io.Reader, meta *MediaMetadata) error {
 	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
 		return fmt.Errorf("error creating directory: %w", err)
 	}
 
-	f, err := os.Create(filePath)
+	if meta != nil && strings.EqualFold(filepath.Ext(filePath), ".mp4") {
+		return d.saveVideo(ctx, filePath, content, meta)
+	}
+	if meta != nil {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("error reading image: %w", err)
+		}
+		if tagged, err := EmbedImageMetadata(data, meta); err != nil {
+			d.log().Warn("embedding metadata failed", "path", filePath, "error", err)
+		} else {
+			data = tagged
+		}
+		content = bytes.NewReader(data)
+	}
+
+	return writeFileAtomic(ctx, filePath, content, 0644)
+}
+
+// saveVideo downloads content to a hidden temporary file, as the movie box
+// may come after the media data, and saves it to filePath with meta.
+func (d *Downloader) saveVideo(ctx context.Context, filePath string, content io.Reader, meta *MediaMetadata) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.part")
 	if err != nil {
-		return fmt.Errorf("error creating file: %w", err)
+		return fmt.Errorf("error creating temporary file: %w", err)
 	}
-	defer f.Close()
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
 
-	if _, err = io.Copy(f, content); err != nil {
+	size, err := io.Copy(tmp, &ctxReader{ctx, content})
+	if err != nil {
 		return fmt.Errorf("error writing file: %w", err)
 	}
-
-	return nil
+	tagged, err := EmbedVideoMetadata(tmp, size, meta)
+	if err != nil {
+		d.log().Warn("embedding metadata failed", "path", filePath, "error", err)
+		tagged = io.NewSectionReader(tmp, 0, size)
+	}
+	return writeFileAtomic(ctx, filePath, tagged, 0644)
 }
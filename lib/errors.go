@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Outcomes callers can test for with errors.Is.
+var (
+	ErrAlreadyExists = errors.New("already exists")
+	ErrRateLimited   = errors.New("rate limited")
+	ErrNotFound      = errors.New("not found")
+	ErrProtected     = errors.New("protected")
+	ErrAuthRequired  = errors.New("authentication required")
+)
+
+// StatusError is an unexpected HTTP status answered for a media file. It
+// matches ErrRateLimited, ErrNotFound or ErrProtected when the code means so.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error: status code %d", e.Code)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrRateLimited:
+		return e.Code == 429
+	case ErrNotFound:
+		return e.Code == 404 || e.Code == 410
+	case ErrProtected:
+		return e.Code == 401 || e.Code == 403
+	}
+	return false
+}
+
+// kindError attaches one of the sentinels above to an error without changing
+// its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// scraperStatusRegex matches the message of an HTTP error of the scraper,
+// which goes on with the response body.
+var scraperStatusRegex = regexp.MustCompile(`^response status (\d{3})\b`)
+
+// scraperError classifies an error of the scraper, which only reports plain
+// messages, so that it matches the sentinel it stands for. HTTP errors are
+// classified by their status alone, never by the body that follows it.
+func scraperError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := strings.ToLower(err.Error())
+	var kind error
+	if m := scraperStatusRegex.FindStringSubmatch(msg); m != nil {
+		switch m[1] {
+		case "429":
+			kind = ErrRateLimited
+		case "401":
+			kind = ErrAuthRequired
+		case "403":
+			kind = ErrProtected
+		case "404":
+			kind = ErrNotFound
+		default:
+			return err
+		}
+		return &kindError{kind, err}
+	}
+
+	switch {
+	case strings.Contains(msg, "is not logged in"):
+		kind = ErrAuthRequired
+	case strings.HasPrefix(msg, "tweet with id ") && strings.HasSuffix(msg, " not found"),
+		msg == "rest_id not found",
+		strings.HasPrefix(msg, "either @") && strings.HasSuffix(msg, " does not exist or is private"):
+		kind = ErrNotFound
+	default:
+		return err
+	}
+	return &kindError{kind, err}
+}
@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	twitterscraper "github.com/imperatrona/twitter-scraper"
+)
+
+// EventType tells what an Event reports.
+type EventType int
+
+const (
+	// EventTweet reports a tweet about to be downloaded.
+	EventTweet EventType = iota + 1
+	// EventMediaStarted reports a transfer starting; Media has no Status yet.
+	EventMediaStarted
+	// EventMediaFinished reports a media file saved to Media.Path.
+	EventMediaFinished
+	// EventMediaSkipped reports a media file not transferred, Media.Err says
+	// why.
+	EventMediaSkipped
+	// EventMediaFailed reports a media file that could not be saved.
+	EventMediaFailed
+	// EventMediaPlanned reports a media file that -dry-run or -url would
+	// transfer.
+	EventMediaPlanned
+)
+
+var mediaEvents = map[MediaStatus]EventType{
+	MediaPlanned:    EventMediaPlanned,
+	MediaDownloaded: EventMediaFinished,
+	MediaSkipped:    EventMediaSkipped,
+	MediaFailed:     EventMediaFailed,
+}
+
+func (t EventType) String() string {
+	switch t {
+	case EventTweet:
+		return "tweet"
+	case EventMediaStarted:
+		return "media-started"
+	case EventMediaFinished:
+		return "media-finished"
+	case EventMediaSkipped:
+		return "media-skipped"
+	case EventMediaFailed:
+		return "media-failed"
+	case EventMediaPlanned:
+		return "media-planned"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is a step of a download in progress.
+type Event struct {
+	Type  EventType
+	Tweet *twitterscraper.Tweet
+	Media *MediaResult
+	// ctx is the context of the transfer the event is about, for hooks that
+	// do work of their own.
+	ctx context.Context
+}
+
+// AddHook registers h to be called for every Event. Hooks run synchronously
+// on the goroutine doing the work, which may be any of the concurrent
+// transfers, so they must be safe for concurrent use and should be quick.
+// Register hooks before the download starts.
+func (d *Downloader) AddHook(h func(Event)) {
+	d.hooks = append(d.hooks, h)
+}
+
+func (d *Downloader) emit(e Event) {
+	for _, h := range d.hooks {
+		h(e)
+	}
+}
+
+func (d *Downloader) tweetFound(tweet *twitterscraper.Tweet) {
+	d.progress.AddTweet()
+	d.emit(Event{Type: EventTweet, Tweet: tweet})
+}
+
+// execHook returns a hook that runs command after every saved media file.
+// The command is split into words before the placeholders {path},
+// {tweet_id}, {url} and {type} are replaced, so no quoting is needed for
+// them.
+func (d *Downloader) execHook(command []string) func(Event) {
+	return func(e Event) {
+		if e.Type != EventMediaFinished {
+			return
+		}
+		r := e.Media
+		args := expandCommand(command, strings.NewReplacer(
+			"{path}", r.Path,
+			"{tweet_id}", r.TweetID,
+			"{url}", r.URL,
+			"{type}", r.Type,
+		))
+		ctx := e.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		d.runCommand(ctx, args)
+	}
+}
+
+// runCommand runs args and passes its output on as lines of the Downloader.
+func (d *Downloader) runCommand(ctx context.Context, args []string) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(string(bytes.TrimRight(out, "\n")), "\n") {
+		if line != "" {
+			d.progress.Println(line)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("error running %s: %w", args[0], err)
+		d.log().Warn("command failed", "command", args, "error", err)
+	}
+	return err
+}
+
+func expandCommand(command []string, r *strings.Replacer) []string {
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = r.Replace(arg)
+	}
+	return args
+}
+
+// SplitCommand splits a command line into words like a POSIX shell would,
+// honouring single quotes, double quotes and backslash escapes, but without
+// any expansion.
+func SplitCommand(s string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	twitterscraper "github.com/imperatrona/twitter-scraper"
+)
+
+// Formats of `twmd export`.
+const (
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+)
+
+var exportCSVHeader = []string{
+	"id", "date", "username", "name", "permalink", "text",
+	"is_retweet", "is_reply", "is_quote", "in_reply_to_id", "quoted_id", "retweeted_id",
+	"likes", "retweets", "replies", "views", "sensitive",
+	"hashtags", "mentions", "urls", "media_urls", "media_paths",
+}
+
+// RunExport implements `twmd export`: it writes one record per timeline
+// tweet of a user, text-only tweets included, with the media URLs and the
+// paths of the media files already downloaded to the user folder. Cancelling
+// stop ends the export early, keeping the records written so far.
+func RunExport(stop context.Context, args []string) error {
+	cfg := &Config{
+		Size:          "large",
+		ProxyStrategy: ProxyRoundRobin,
+		Transport:     DefaultTransportOptions,
+	}
+	var format, out string
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&cfg.User, "user", "", "User whose timeline to export")
+	flags.StringVar(&format, "format", ExportJSONL, "Output format: jsonl or csv")
+	flags.StringVar(&out, "o", "", "File to write to instead of stdout")
+	flags.IntVar(&cfg.NumberOfTweets, "N", 100, "Number of tweets to export")
+	flags.StringVar(&cfg.OutputDir, "output", "", "Directory the media were downloaded to, to find their paths")
+	flags.StringVar(&cfg.OutputTemplate, "output-template", DefaultOutputTemplate, "Output template the media were downloaded with")
+	flags.StringVar(&cfg.Format, "file-format", "", "File format the media were downloaded with")
+	flags.StringVar(&cfg.Datefmt, "date-format", "", "Date format the media were downloaded with")
+	flags.StringVar(&cfg.Size, "size", "large", "Image size the media were downloaded with: small, normal or large")
+	flags.StringVar(&cfg.Proxy, "proxy", "", "Use proxy (http|https|socks5://[user:pass@]ip:port)")
+	flags.DurationVar(&cfg.RequestDelay, "request-delay", 0, "Minimum delay between scraper requests, e.g. 2s")
+	addLogFlags(flags, cfg)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: twmd export -user USER [options]\n\nWrite the tweets of a user's timeline as JSON lines or CSV.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if cfg.User == "" {
+		quitWithError(flags, "You must specify a user (-user)")
+	}
+	if format != ExportJSONL && format != ExportCSV {
+		quitWithError(flags, "Error in format: Must be one of jsonl, csv")
+	}
+	if err := cfg.Validate(); err != nil {
+		var cerr *ConfigError
+		if errors.As(err, &cerr) {
+			quitWithError(flags, "Error in "+cerr.Field+": "+cerr.Msg)
+		}
+		return err
+	}
+	cfg.OutputBase = cfg.OutputDir
+	cfg.OutputDir = filepath.Join(cfg.OutputDir, cfg.User)
+
+	logger, logFile, err := OpenLogger(cfg, os.Stderr)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cfg.Logger = logger
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %w", out, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	httpClient, err := NewHTTPClient(cfg.Proxy, cfg.Transport)
+	if err != nil {
+		return err
+	}
+	runner, err := NewScraper(cfg, httpClient)
+	if err != nil {
+		return err
+	}
+	// Saved cookies give access to sensitive tweets; without them the export
+	// goes on logged out.
+	NewAuthenticator(runner.scraper, cfg).tryLoadCookies()
+
+	ctx, cancel := context.WithCancel(stop)
+	defer cancel()
+	tweets := runner.userTweets(ctx, cfg.User, cfg.NumberOfTweets, "", 0)
+
+	exporter := newExporter(w, format, runner.downloader)
+	count := 0
+	for tweet := range tweets {
+		if errors.Is(tweet.err, context.Canceled) {
+			logger.Warn("export interrupted", "user", cfg.User, "tweets", count)
+			break
+		}
+		if tweet.err != nil {
+			exporter.Flush()
+			return tweet.err
+		}
+		if err := exporter.Write(&tweet.Tweet); err != nil {
+			// Stop the crawl and let it finish its last send.
+			cancel()
+			for range tweets {
+			}
+			return err
+		}
+		count++
+	}
+	if err := exporter.Flush(); err != nil {
+		return err
+	}
+	logger.Info("export done", "user", cfg.User, "tweets", count)
+	return nil
+}
+
+// exporter writes tweets in one of the export formats.
+type exporter struct {
+	format string
+	d      *Downloader
+	enc    *json.Encoder
+	csv    *csv.Writer
+}
+
+func newExporter(w io.Writer, format string, d *Downloader) *exporter {
+	e := &exporter{format: format, d: d}
+	if format == ExportCSV {
+		e.csv = csv.NewWriter(w)
+		e.csv.Write(exportCSVHeader)
+	} else {
+		e.enc = json.NewEncoder(w)
+		e.enc.SetEscapeHTML(false)
+	}
+	return e
+}
+
+func (e *exporter) Write(tweet *twitterscraper.Tweet) error {
+	info := NewTweetInfo(tweet)
+	for _, f := range tweetMedia(tweet, e.d.config.Size) {
+		m := MediaInfo{Index: f.index, Type: f.fileType, URL: f.url}
+		path, _ := e.d.determineFilePath(tweet, f, e.d.generateFileName(tweet, f))
+		if _, err := os.Stat(path); err == nil {
+			m.File = path
+		}
+		info.Media = append(info.Media, m)
+	}
+
+	if e.format == ExportJSONL {
+		if err := e.enc.Encode(info); err != nil {
+			return fmt.Errorf("error writing export: %w", err)
+		}
+		return nil
+	}
+
+	var mentions, mediaURLs, mediaPaths []string
+	for _, m := range info.Mentions {
+		mentions = append(mentions, m.Username)
+	}
+	for _, m := range info.Media {
+		mediaURLs = append(mediaURLs, m.URL)
+		mediaPaths = append(mediaPaths, m.File)
+	}
+	// Lists are one item per line within their cell.
+	record := []string{
+		info.ID, info.Date.Format(time.RFC3339), info.Author.Username, info.Author.Name, info.Permalink, info.Text,
+		strconv.FormatBool(info.IsRetweet), strconv.FormatBool(info.IsReply), strconv.FormatBool(info.IsQuote),
+		info.InReplyToID, info.QuotedID, info.RetweetedID,
+		strconv.Itoa(info.Likes), strconv.Itoa(info.Retweets), strconv.Itoa(info.Replies), strconv.Itoa(info.Views),
+		strconv.FormatBool(info.Sensitive),
+		strings.Join(info.Hashtags, "\n"), strings.Join(mentions, "\n"), strings.Join(info.URLs, "\n"),
+		strings.Join(mediaURLs, "\n"), strings.Join(mediaPaths, "\n"),
+	}
+	if err := e.csv.Write(record); err != nil {
+		return fmt.Errorf("error writing export: %w", err)
+	}
+	return nil
+}
+
+func (e *exporter) Flush() error {
+	if e.csv == nil {
+		return nil
+	}
+	e.csv.Flush()
+	if err := e.csv.Error(); err != nil {
+		return fmt.Errorf("error writing export: %w", err)
+	}
+	return nil
+}
@@ -1,75 +1,74 @@
 package lib
 
 import (
-	"fmt"
+	"errors"
 	"regexp"
 	"strings"
-	"time"
 
 	twitterscraper "github.com/imperatrona/twitter-scraper"
 )
 
-// TODO: Learn strings.Builder
+// legacyFormatRegex matches the file formats of before templates: tokens
+// separated by spaces, which were joined with _.
+var legacyFormatRegex = regexp.MustCompile(`^\{[A-Z_]+\}( +\{[A-Z_]+\})*$`)
 
-// FormatFileName generates a formatted file name based on the given tweet and format string.
-func FormatFileName(tweet *twitterscraper.Tweet, format string, dateFormat string) (string, error) {
-	formatParts := strings.Split(format, " ")
-	formattedName := make([]string, 0, len(formatParts))
+var titleInvalidChars = regexp.MustCompile(`[/\\:*?"<>|]`)
 
-	invalidCharsRegex, err := regexp.Compile(`[/\\:*?"<>|]`)
+// ParseFileFormat checks the -file-format format, written in the language of
+// Template. It names files, so it can't hold separators or {FILENAME}. A
+// format with {EXT} is the whole file name; others are prefixed to the name
+// of the file on the CDN.
+func ParseFileFormat(format string) (*Template, error) {
+	if legacyFormatRegex.MatchString(format) {
+		format = strings.Join(strings.Fields(format), "_")
+	}
+	if strings.ContainsAny(format, `/\`) {
+		return nil, errors.New("must not contain / or \\")
+	}
+	t, err := parseTemplate(format, "FILENAME")
 	if err != nil {
-		return "", fmt.Errorf("error compiling regular expression: %w", err)
+		return nil, err
 	}
-
-	for _, part := range formatParts {
-		formatted, err := formatPart(tweet, part, invalidCharsRegex, dateFormat)
-		if err != nil {
-			return "", err
-		}
-		formattedName = append(formattedName, formatted)
+	if len(t.tokens) == 0 {
+		return nil, errors.New("must include at least one token, like {ID} or {DATE}")
 	}
-
-	return strings.Join(formattedName, "_"), nil
+	if t.Uses("EXT") && !t.Uses("FILE") && !t.Uses("MEDIA_ID") && !(t.Uses("ID") && t.Uses("INDEX")) {
+		return nil, errors.New("with {EXT}, must include {FILE}, {MEDIA_ID} or {ID} with {INDEX} so that every file gets its own name")
+	}
+	return t, nil
 }
 
-func formatPart(tweet *twitterscraper.Tweet, part string, invalidCharsRegex *regexp.Regexp, dateFormat string) (string, error) {
-	switch part {
-	case "{DATE}":
-		return formatDate(tweet.Timestamp, dateFormat)
-	case "{NAME}":
-		return tweet.Name, nil
-	case "{USERNAME}":
-		return tweet.Username, nil
-	case "{TITLE}":
-		return formatTitle(tweet, invalidCharsRegex)
-	case "{ID}":
-		return tweet.ID, nil
-	default:
-		return "", fmt.Errorf("invalid format part: %s", part)
+// FormatFileName generates a formatted file name based on the given tweet and format string.
+func FormatFileName(tweet *twitterscraper.Tweet, format string, dateFormat string) (string, error) {
+	t, err := ParseFileFormat(format)
+	if err != nil {
+		return "", err
 	}
+	return formatFileName(t, &mediaFile{tweet: tweet, datefmt: dateFormat}), nil
 }
 
-func formatDate(timestamp int64, dateFormat string) (string, error) {
-	t := time.Unix(timestamp, 0)
-	return t.Format(dateFormat), nil
+// formatFileName expands the file format t for m. Separators in token values
+// become _.
+func formatFileName(t *Template, m *mediaFile) string {
+	return t.execute(m, func(_, value string) string {
+		return pathSeparators.ReplaceAllString(value, "_")
+	})
 }
 
-func formatTitle(tweet *twitterscraper.Tweet, invalidCharsRegex *regexp.Regexp) (string, error) {
+// formatTitle returns the tweet text, cut to what fits in a file name with
+// the tweet ID.
+func formatTitle(tweet *twitterscraper.Tweet) string {
 	text := strings.ReplaceAll(tweet.Text, "/", "_")
 	remainingChars := 251 - len(tweet.ID) - 4
 
-	if text == "" {
-		return "", nil
-	}
-
 	if len(text) <= remainingChars {
-		return text, nil
+		return text
 	}
 
-	return processText(text, remainingChars, invalidCharsRegex), nil
+	return processText(text, remainingChars)
 }
 
-func processText(text string, remainingChars int, invalidCharsRegex *regexp.Regexp) string {
+func processText(text string, remainingChars int) string {
 	var result strings.Builder
 
 	for _, char := range text {
@@ -77,8 +76,7 @@ func processText(text string, remainingChars int, invalidCharsRegex *regexp.Rege
 			break
 		}
 
-		charStr := string(char)
-		if invalidCharsRegex.MatchString(charStr) {
+		if titleInvalidChars.MatchString(string(char)) {
 			if remainingChars > 1 {
 				result.WriteRune('_')
 				remainingChars--
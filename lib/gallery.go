@@ -0,0 +1,402 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const galleryDir = "gallery"
+
+var videoExts = map[string]bool{
+	".mp4":  true,
+	".mov":  true,
+	".webm": true,
+}
+
+// galleryItem is a media file as shown in the gallery. Paths are relative to
+// the gallery's index.html.
+type galleryItem struct {
+	Src       string   `json:"src"`
+	Thumb     string   `json:"thumb,omitempty"`
+	Type      string   `json:"type"`
+	File      string   `json:"file"`
+	Date      int64    `json:"date"`
+	TweetID   string   `json:"id,omitempty"`
+	Permalink string   `json:"url,omitempty"`
+	Author    string   `json:"author,omitempty"`
+	Text      string   `json:"text,omitempty"`
+	Hashtags  []string `json:"tags,omitempty"`
+}
+
+// RunGallery implements `twmd gallery DIR`: it writes a static HTML gallery
+// of the media anywhere in a downloaded user folder to DIR/gallery, with
+// thumbnails of the images. Tweet texts and links come from the .info.json
+// sidecars of -write-info-json.
+func RunGallery(args []string) error {
+	flags := flag.NewFlagSet("gallery", flag.ExitOnError)
+	perPage := flags.Int("per-page", 60, "Media per page")
+	thumbSize := flags.Int("thumb-size", 320, "Maximum width and height of thumbnails in pixels")
+	force := flags.Bool("force", false, "Make the thumbnails again even if they are up to date")
+	cfg := &Config{}
+	addLogFlags(flags, cfg)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: twmd gallery [options] DIR\n\nWrite a static HTML gallery of a downloaded user folder to DIR/%s.\n\n", galleryDir)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		quitWithError(flags, "You must specify the user folder")
+	}
+	if *perPage < 1 {
+		quitWithError(flags, "Error in per-page: Must be at least 1")
+	}
+	if *thumbSize < 16 {
+		quitWithError(flags, "Error in thumb-size: Must be at least 16")
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		quitWithError(flags, "Error in log-format: Must be one of text, json")
+	}
+
+	logger, logFile, err := OpenLogger(cfg, os.Stderr)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	dir := flags.Arg(0)
+	outDir := filepath.Join(dir, galleryDir)
+	thumbDir := filepath.Join(outDir, "thumbs")
+	if err := os.MkdirAll(thumbDir, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+
+	tweets := loadInfoJSON(dir, logger)
+	var items []galleryItem
+	err = filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := e.Name()
+		if e.IsDir() {
+			if path != dir && (strings.HasPrefix(name, ".") || path == outDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(name))
+		if strings.HasPrefix(name, ".") || (!imageExts[ext] && !videoExts[ext]) {
+			return nil
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		item := galleryItem{
+			Src:  "../" + escapePath(rel),
+			Type: "img",
+			File: name,
+			Date: info.ModTime().Unix(),
+		}
+		if videoExts[ext] {
+			item.Type = "video"
+		}
+		if tweet, ok := tweets[name]; ok {
+			item.Date = tweet.Timestamp
+			item.TweetID = tweet.ID
+			item.Permalink = tweet.Permalink
+			item.Author = tweet.Author.Username
+			item.Text = tweet.Text
+			item.Hashtags = tweet.Hashtags
+		}
+		if item.Type == "img" {
+			thumb := thumbnailName(rel)
+			if err := makeThumbnail(path, filepath.Join(thumbDir, thumb), *thumbSize, *force); err != nil {
+				logger.Warn("no thumbnail", "file", rel, "error", err)
+			} else {
+				item.Thumb = "thumbs/" + thumb
+			}
+		}
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("no media in %s", dir)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Date > items[j].Date })
+
+	index := filepath.Join(outDir, "index.html")
+	f, err := os.Create(index)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", index, err)
+	}
+	defer f.Close()
+	err = galleryTemplate.Execute(f, map[string]any{
+		"Title":   filepath.Base(filepath.Clean(dir)),
+		"Items":   items,
+		"PerPage": *perPage,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", index, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %w", index, err)
+	}
+	logger.Info("gallery written", "media", len(items), "file", index)
+	return nil
+}
+
+// thumbnailName names the thumbnail of the media file at rel after a hash of
+// its path, which is unique where flattening the folders into the name isn't.
+func thumbnailName(rel string) string {
+	sum := sha256.Sum256([]byte(rel))
+	return hex.EncodeToString(sum[:12]) + ".jpg"
+}
+
+// escapePath escapes each segment of the slash-separated path rel for use
+// in a URL, so that names with # or ? still link to their file.
+func escapePath(rel string) string {
+	segments := strings.Split(rel, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// loadInfoJSON reads the .info.json sidecars anywhere in dir and maps each
+// media file name to its tweet. Unreadable sidecars are logged and skipped.
+func loadInfoJSON(dir string, logger *slog.Logger) map[string]*TweetInfo {
+	tweets := make(map[string]*TweetInfo)
+	filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() || !strings.HasSuffix(path, infoJSONExt) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var info TweetInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			logger.Warn("ignoring invalid sidecar", "file", path, "error", err)
+			return nil
+		}
+		for _, m := range info.Media {
+			tweets[m.File] = &info
+		}
+		return nil
+	})
+	return tweets
+}
+
+// makeThumbnail writes a JPEG of src scaled down to fit size x size, unless
+// dst is newer than src.
+func makeThumbnail(src, dst string, size int, force bool) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && !force && !dstInfo.ModTime().Before(srcInfo.ModTime()) {
+		return nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, scaleDown(img, size), &jpeg.Options{Quality: 80}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// scaleDown returns img scaled to fit size x size, averaging the pixels each
+// thumbnail pixel covers. Smaller images are returned as is.
+func scaleDown(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	tw, th = max(tw, 1), max(th, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0 := b.Min.Y + y*h/th
+		y1 := max(b.Min.Y+(y+1)*h/th, y0+1)
+		for x := 0; x < tw; x++ {
+			x0 := b.Min.X + x*w/tw
+			x1 := max(b.Min.X+(x+1)*w/tw, x0+1)
+			// Sample about 4x4 pixels per cell, a coarser grid than the
+			// 16x16 of averageLuma as thumbnail cells are small.
+			stepX, stepY := max((x1-x0)/4, 1), max((y1-y0)/4, 1)
+			var r, g, bl, n uint32
+			for sy := y0; sy < y1; sy += stepY {
+				for sx := x0; sx < x1; sx += stepX {
+					cr, cg, cb, _ := img.At(sx, sy).RGBA()
+					r, g, bl, n = r+cr>>8, g+cg>>8, bl+cb>>8, n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 255})
+		}
+	}
+	return dst
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Funcs(template.FuncMap{
+	"now": func() string { return time.Now().Format("2006-01-02 15:04") },
+}).Parse(galleryHTML))
+
+// galleryHTML is the whole gallery: the media list is embedded as JSON so the
+// page works from file:// without requests.
+const galleryHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} – twmd gallery</title>
+<style>
+body { margin: 0; font: 14px/1.4 system-ui, sans-serif; background: #111; color: #ddd; }
+header { position: sticky; top: 0; z-index: 1; display: flex; flex-wrap: wrap; gap: 8px; align-items: center; padding: 10px 16px; background: #1b1b1b; border-bottom: 1px solid #333; }
+header h1 { margin: 0 12px 0 0; font-size: 18px; }
+input, select, button { font: inherit; color: inherit; background: #222; border: 1px solid #444; border-radius: 4px; padding: 4px 8px; }
+input[type=search] { flex: 1; min-width: 160px; }
+button:disabled { opacity: .4; }
+#count { color: #888; }
+main { display: grid; grid-template-columns: repeat(auto-fill, minmax(220px, 1fr)); gap: 12px; padding: 16px; }
+.card { background: #1b1b1b; border-radius: 6px; overflow: hidden; display: flex; flex-direction: column; }
+.card a.media { display: block; background: #000; aspect-ratio: 1; }
+.card img, .card video { width: 100%; height: 100%; object-fit: cover; display: block; }
+.card .meta { padding: 8px; display: flex; flex-direction: column; gap: 4px; }
+.card .text { display: -webkit-box; -webkit-line-clamp: 4; -webkit-box-orient: vertical; overflow: hidden; white-space: pre-wrap; }
+.card .info { color: #888; font-size: 12px; display: flex; justify-content: space-between; gap: 8px; }
+.card .info a { color: #6ab0ff; }
+.card .file { color: #666; font-size: 11px; word-break: break-all; }
+nav { display: flex; justify-content: center; align-items: center; gap: 8px; padding: 0 16px 24px; }
+footer { text-align: center; color: #555; font-size: 12px; padding-bottom: 16px; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<input type="search" id="filter" placeholder="Filter by text, #hashtag, author or file name">
+<select id="type"><option value="">All media</option><option value="img">Images</option><option value="video">Videos</option></select>
+<select id="order"><option value="new">Newest first</option><option value="old">Oldest first</option></select>
+<span id="count"></span>
+</header>
+<main id="grid"></main>
+<nav><button id="prev">&larr; Previous</button><span id="page"></span><button id="next">Next &rarr;</button></nav>
+<footer>Made by twmd on {{now}}</footer>
+<script>
+const items = {{.Items}};
+const perPage = {{.PerPage}};
+let page = 0;
+let shown = items;
+
+const $ = id => document.getElementById(id);
+
+function matches(item, words) {
+  const haystack = [item.text, item.author, item.file, item.id, (item.tags || []).map(t => "#" + t).join(" ")].join(" ").toLowerCase();
+  return words.every(w => haystack.includes(w));
+}
+
+function update() {
+  const words = $("filter").value.toLowerCase().split(/\s+/).filter(w => w);
+  const type = $("type").value;
+  shown = items.filter(item => (!type || item.type === type) && matches(item, words));
+  if ($("order").value === "old") {
+    shown = shown.slice().reverse();
+  }
+  page = 0;
+  render();
+}
+
+function el(tag, props, children) {
+  const e = Object.assign(document.createElement(tag), props || {});
+  (children || []).forEach(c => e.append(c));
+  return e;
+}
+
+function render() {
+  const pages = Math.max(1, Math.ceil(shown.length / perPage));
+  page = Math.min(page, pages - 1);
+  const grid = $("grid");
+  grid.replaceChildren();
+  for (const item of shown.slice(page * perPage, (page + 1) * perPage)) {
+    let media;
+    if (item.type === "video") {
+      media = el("video", {src: item.src + "#t=0.1", preload: "metadata", controls: true, muted: true});
+    } else {
+      media = el("img", {src: item.thumb || item.src, loading: "lazy", alt: item.text || item.file});
+    }
+    const link = el("a", {className: "media", href: item.src, target: "_blank"}, [media]);
+    const date = new Date(item.date * 1000).toLocaleString();
+    const info = el("div", {className: "info"}, [el("span", {textContent: date})]);
+    if (item.url) {
+      info.append(el("a", {href: item.url, target: "_blank", rel: "noopener", textContent: "@" + item.author + " ↗"}));
+    }
+    const meta = el("div", {className: "meta"}, [info]);
+    if (item.text) {
+      meta.append(el("div", {className: "text", textContent: item.text}));
+    }
+    meta.append(el("div", {className: "file", textContent: item.file}));
+    grid.append(el("div", {className: "card"}, [link, meta]));
+  }
+  $("count").textContent = shown.length + " of " + items.length;
+  $("page").textContent = "Page " + (page + 1) + " of " + pages;
+  $("prev").disabled = page === 0;
+  $("next").disabled = page >= pages - 1;
+  location.hash = page > 0 ? "page=" + (page + 1) : "";
+}
+
+$("filter").addEventListener("input", update);
+$("type").addEventListener("change", update);
+$("order").addEventListener("change", update);
+$("prev").addEventListener("click", () => { page--; render(); window.scrollTo(0, 0); });
+$("next").addEventListener("click", () => { page++; render(); window.scrollTo(0, 0); });
+
+update();
+const start = /page=(\d+)/.exec(location.hash);
+if (start) {
+  page = parseInt(start[1], 10) - 1;
+  render();
+}
+</script>
+</body>
+</html>
+`
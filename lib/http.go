@@ -1,9 +1,13 @@
 package lib
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,28 +15,125 @@ type HTTPClient interface {
 	Do(*http.Request) (*http.Response, error)
 }
 
-func NewHTTPClient(proxyURL string) HTTPClient {
-	// Create and return an http.Client with the given proxy settings
+// TransportOptions tunes the HTTP client used for media downloads.
+type TransportOptions struct {
+	ConnectTimeout time.Duration // TCP connect and TLS handshake
+	HeaderTimeout  time.Duration // waiting for response headers
+	IdleTimeout    time.Duration // keeping unused connections in the pool
+	Timeout        time.Duration // whole request including the body, 0 for none
+	StallTimeout   time.Duration // no body bytes received, 0 for none
+}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout: time.Duration(5) * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout:   time.Duration(5) * time.Second,
-			ResponseHeaderTimeout: 5 * time.Second,
-			DisableKeepAlives:     true,
-		},
-	}
+var DefaultTransportOptions = TransportOptions{
+	ConnectTimeout: 10 * time.Second,
+	HeaderTimeout:  30 * time.Second,
+	IdleTimeout:    90 * time.Second,
+	StallTimeout:   30 * time.Second,
+}
 
-	return client
+func NewHTTPClient(proxyURL string, opts TransportOptions) (HTTPClient, error) {
+	var parsedURL *url.URL
+	if proxyURL != "" {
+		var err error
+		if parsedURL, err = ParseProxyURL(proxyURL); err != nil {
+			return nil, err
+		}
+	}
+	return newClient(parsedURL, opts), nil
 }
 
-func NewProxyClient(proxyURL string) HTTPClient {
-	parsedURL, _ := url.Parse(proxyURL)
+// newClient builds a client for bulk transfers: connections are kept alive
+// and pooled per host, and HTTP/2 is negotiated where the CDN offers it.
+func newClient(proxy *url.URL, opts TransportOptions) *http.Client {
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   opts.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       opts.IdleTimeout,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.HeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
 	return &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyURL(parsedURL),
-		},
+		Transport: transport,
+		Timeout:   opts.Timeout,
+	}
+}
+
+// stallReader cancels a transfer when no body bytes arrive for timeout,
+// instead of putting a fixed deadline on large downloads.
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+func newStallReader(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *stallReader {
+	r := &stallReader{body: body, timeout: timeout, cancel: cancel}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.stalled.Store(true)
+		cancel()
+	})
+	return r
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && r.stalled.Load() {
+		err = fmt.Errorf("transfer stalled: no data for %s", r.timeout)
+	}
+	return n, err
+}
+
+// pause stops the timeout while the transfer is held back on purpose, e.g.
+// by the bandwidth limiter.
+func (r *stallReader) pause() {
+	r.timer.Stop()
+}
+
+func (r *stallReader) resume() {
+	if !r.stalled.Load() {
+		r.timer.Reset(r.timeout)
+	}
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	err := r.body.Close()
+	r.cancel()
+	return err
+}
+
+// ParseProxyURL validates a proxy address of the form
+// proto://[user:password@]host:port where proto is http, https or socks5.
+func ParseProxyURL(proxyURL string) (*url.URL, error) {
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", proxyURL, err)
+	}
+
+	switch parsedURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	case "":
+		return nil, fmt.Errorf("invalid proxy %q: missing protocol (http://, https:// or socks5://)", proxyURL)
+	default:
+		return nil, fmt.Errorf("invalid proxy %q: unsupported protocol %s", proxyURL, parsedURL.Scheme)
+	}
+
+	if parsedURL.Hostname() == "" || parsedURL.Port() == "" {
+		return nil, fmt.Errorf("invalid proxy %q: must be proto://host:port", proxyURL)
 	}
+	return parsedURL, nil
 }
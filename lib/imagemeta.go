@@ -0,0 +1,351 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	twitterscraper "github.com/imperatrona/twitter-scraper"
+)
+
+// MediaMetadata is the provenance written into saved files by -embed-metadata
+// and -embed-video-metadata.
+type MediaMetadata struct {
+	// Title is only written into videos.
+	Title       string
+	Artist      string
+	Description string
+	Source      string
+	Date        time.Time
+	Keywords    []string
+}
+
+// newMediaMetadata describes a media file of tweet, or of the retweeted tweet.
+func newMediaMetadata(tweet *twitterscraper.Tweet) *MediaMetadata {
+	if tweet.RetweetedStatus != nil {
+		tweet = tweet.RetweetedStatus
+	}
+	artist := "@" + tweet.Username
+	if tweet.Name != "" {
+		artist = tweet.Name + " (@" + tweet.Username + ")"
+	}
+	return &MediaMetadata{
+		Title:       tweetTitle(tweet),
+		Artist:      artist,
+		Description: tweet.Text,
+		Source:      tweet.PermanentURL,
+		Date:        time.Unix(tweet.Timestamp, 0).UTC(),
+		Keywords:    tweet.Hashtags,
+	}
+}
+
+// tweetTitle is the first line of the text of tweet, shortened to 100
+// characters, or its ID if it has no text.
+func tweetTitle(tweet *twitterscraper.Tweet) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(tweet.Text), "\n")
+	if title == "" {
+		return "@" + tweet.Username + " " + tweet.ID
+	}
+	if r := []rune(title); len(r) > 100 {
+		title = string(r[:99]) + "…"
+	}
+	return title
+}
+
+var (
+	jpegSOI      = []byte{0xFF, 0xD8}
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+const (
+	xmpKeyword     = "XML:com.adobe.xmp"
+	maxJPEGSegment = 0xFFFF - 2
+)
+
+// EmbedImageMetadata returns the JPEG or PNG image data with meta stored as
+// EXIF and XMP, replacing any EXIF or XMP it had. The pixel data is copied
+// unchanged.
+func EmbedImageMetadata(data []byte, meta *MediaMetadata) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, jpegSOI):
+		return embedJPEG(data, meta)
+	case bytes.HasPrefix(data, pngSignature):
+		return embedPNG(data, meta)
+	default:
+		return nil, errors.New("unsupported image format")
+	}
+}
+
+// embedJPEG inserts APP1 EXIF and XMP segments after the JFIF (APP0) segments
+// and drops the existing ones. Segments are copied up to the start of scan,
+// the rest of the file as is.
+func embedJPEG(data []byte, meta *MediaMetadata) ([]byte, error) {
+	exif := append(append([]byte{}, exifHeader...), buildTIFF(meta)...)
+	xmp := append(append([]byte{}, xmpHeader...), buildXMP(meta)...)
+	if len(exif) > maxJPEGSegment || len(xmp) > maxJPEGSegment {
+		return nil, errors.New("metadata too large for a JPEG segment")
+	}
+
+	var out bytes.Buffer
+	out.Write(jpegSOI)
+	inserted := false
+	insert := func() {
+		writeJPEGSegment(&out, 0xE1, exif)
+		writeJPEGSegment(&out, 0xE1, xmp)
+		inserted = true
+	}
+
+	pos := len(jpegSOI)
+	for {
+		if pos+4 > len(data) || data[pos] != 0xFF {
+			return nil, errors.New("invalid JPEG segment")
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte.
+			pos++
+			continue
+		}
+		if marker != 0xE0 && !inserted {
+			insert()
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: the rest is image data.
+			out.Write(data[pos:])
+			return out.Bytes(), nil
+		}
+
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		payload := data[pos+4 : end]
+		if marker != 0xE1 || !(bytes.HasPrefix(payload, exifHeader) || bytes.HasPrefix(payload, xmpHeader)) {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+}
+
+func writeJPEGSegment(out *bytes.Buffer, marker byte, payload []byte) {
+	out.Write([]byte{0xFF, marker})
+	binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+}
+
+// embedPNG inserts eXIf and iTXt XMP chunks right after IHDR and drops the
+// existing ones.
+func embedPNG(data []byte, meta *MediaMetadata) ([]byte, error) {
+	var out bytes.Buffer
+	out.Write(pngSignature)
+
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		typ := string(data[pos+4 : pos+8])
+		chunkData := data[pos+8 : pos+8+length]
+
+		switch {
+		case typ == "eXIf":
+		case typ == "iTXt" && bytes.HasPrefix(chunkData, []byte(xmpKeyword+"\x00")):
+		default:
+			out.Write(data[pos:end])
+		}
+		if typ == "IHDR" {
+			writePNGChunk(&out, "eXIf", buildTIFF(meta))
+			itxt := []byte(xmpKeyword + "\x00\x00\x00\x00\x00")
+			writePNGChunk(&out, "iTXt", append(itxt, buildXMP(meta)...))
+		}
+		pos = end
+	}
+	return out.Bytes(), nil
+}
+
+func writePNGChunk(out *bytes.Buffer, typ string, data []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	out.WriteString(typ)
+	out.Write(data)
+	binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+// TIFF tags and field types used in the EXIF block.
+const (
+	tagImageDescription   = 0x010E
+	tagArtist             = 0x013B
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagUserComment        = 0x9286
+
+	typeASCII     = 2
+	typeLong      = 4
+	typeUndefined = 7
+)
+
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiEntry(tag uint16, s string) ifdEntry {
+	value := append([]byte(strings.ReplaceAll(s, "\x00", "")), 0)
+	return ifdEntry{tag, typeASCII, uint32(len(value)), value}
+}
+
+// isASCII reports whether s fits the 7-bit ASCII that EXIF text tags require.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// userCommentEntry holds s as a UserComment in UCS-2, big-endian like the
+// rest of the block, for text that isn't ASCII.
+func userCommentEntry(s string) ifdEntry {
+	value := []byte("UNICODE\x00")
+	for _, u := range utf16.Encode([]rune(s)) {
+		value = binary.BigEndian.AppendUint16(value, u)
+	}
+	return ifdEntry{tagUserComment, typeUndefined, uint32(len(value)), value}
+}
+
+// ifdSize is the size of an IFD with its values, padded to an even length.
+func ifdSize(entries []ifdEntry) int {
+	size := 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			size += len(e.value) + len(e.value)%2
+		}
+	}
+	return size
+}
+
+// writeIFD writes entries, sorted by tag, as an IFD starting at offset in the
+// TIFF block, with the values that don't fit an entry after it.
+func writeIFD(out *bytes.Buffer, offset int, entries []ifdEntry) {
+	be := binary.BigEndian
+	dataOffset := offset + 2 + 12*len(entries) + 4
+	var values bytes.Buffer
+
+	binary.Write(out, be, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(out, be, e.tag)
+		binary.Write(out, be, e.typ)
+		binary.Write(out, be, e.count)
+		if len(e.value) <= 4 {
+			var inline [4]byte
+			copy(inline[:], e.value)
+			out.Write(inline[:])
+			continue
+		}
+		binary.Write(out, be, uint32(dataOffset+values.Len()))
+		values.Write(e.value)
+		if len(e.value)%2 == 1 {
+			values.WriteByte(0)
+		}
+	}
+	binary.Write(out, be, uint32(0))
+	out.Write(values.Bytes())
+}
+
+// buildTIFF returns the big-endian TIFF block holding the EXIF fields: IFD0
+// with description and artist, and the Exif IFD with the original date and a
+// description that is not ASCII.
+func buildTIFF(meta *MediaMetadata) []byte {
+	exifIFD := []ifdEntry{
+		asciiEntry(tagDateTimeOriginal, meta.Date.Format("2006:01:02 15:04:05")),
+		asciiEntry(tagOffsetTimeOriginal, meta.Date.Format("-07:00")),
+	}
+
+	// Text tags only take ASCII. Other descriptions go in the UserComment,
+	// which can be Unicode; XMP holds every field in UTF-8 anyway.
+	var ifd0 []ifdEntry
+	if meta.Description != "" {
+		if isASCII(meta.Description) {
+			ifd0 = append(ifd0, asciiEntry(tagImageDescription, meta.Description))
+		} else {
+			exifIFD = append(exifIFD, userCommentEntry(meta.Description))
+		}
+	}
+	if meta.Artist != "" && isASCII(meta.Artist) {
+		ifd0 = append(ifd0, asciiEntry(tagArtist, meta.Artist))
+	}
+	pointer := ifdEntry{tagExifIFD, typeLong, 1, make([]byte, 4)}
+	ifd0 = append(ifd0, pointer)
+
+	const ifd0Offset = 8
+	exifOffset := ifd0Offset + ifdSize(ifd0)
+	binary.BigEndian.PutUint32(pointer.value, uint32(exifOffset))
+
+	var out bytes.Buffer
+	out.WriteString("MM")
+	binary.Write(&out, binary.BigEndian, uint16(42))
+	binary.Write(&out, binary.BigEndian, uint32(ifd0Offset))
+	writeIFD(&out, ifd0Offset, ifd0)
+	writeIFD(&out, exifOffset, exifIFD)
+	return out.Bytes()
+}
+
+// buildXMP returns an XMP packet with the Dublin Core fields the EXIF block
+// can't hold: source and keywords, and the others again for XMP-only tools.
+func buildXMP(meta *MediaMetadata) []byte {
+	var b strings.Builder
+	esc := func(s string) string {
+		var e strings.Builder
+		xml.EscapeText(&e, []byte(s))
+		return e.String()
+	}
+	date := meta.Date.Format(time.RFC3339)
+
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"")
+	b.WriteString(" xmlns:dc=\"http://purl.org/dc/elements/1.1/\"")
+	b.WriteString(" xmlns:photoshop=\"http://ns.adobe.com/photoshop/1.0/\"")
+	b.WriteString(" xmlns:exif=\"http://ns.adobe.com/exif/1.0/\">\n")
+	if meta.Artist != "" {
+		fmt.Fprintf(&b, "   <dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n", esc(meta.Artist))
+	}
+	if meta.Description != "" {
+		fmt.Fprintf(&b, "   <dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n", esc(meta.Description))
+	}
+	if meta.Source != "" {
+		fmt.Fprintf(&b, "   <dc:source>%s</dc:source>\n", esc(meta.Source))
+	}
+	if len(meta.Keywords) > 0 {
+		b.WriteString("   <dc:subject><rdf:Bag>")
+		for _, k := range meta.Keywords {
+			fmt.Fprintf(&b, "<rdf:li>%s</rdf:li>", esc(k))
+		}
+		b.WriteString("</rdf:Bag></dc:subject>\n")
+	}
+	fmt.Fprintf(&b, "   <photoshop:DateCreated>%s</photoshop:DateCreated>\n", date)
+	fmt.Fprintf(&b, "   <exif:DateTimeOriginal>%s</exif:DateTimeOriginal>\n", date)
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return []byte(b.String())
+}
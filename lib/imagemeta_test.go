@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8(x ^ y), 255})
+		}
+	}
+	return img
+}
+
+func testMetadata(description, artist string) *MediaMetadata {
+	return &MediaMetadata{
+		Artist:      artist,
+		Description: description,
+		Source:      "https://twitter.com/user/status/1",
+		Date:        time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+		Keywords:    []string{"trains"},
+	}
+}
+
+// tiffEntries reads the entries of the IFD at offset of the big-endian TIFF
+// block, with their values.
+func tiffEntries(t *testing.T, tiff []byte, offset uint32) map[uint16][]byte {
+	t.Helper()
+	be := binary.BigEndian
+	entries := make(map[uint16][]byte)
+	n := int(be.Uint16(tiff[offset:]))
+	for i := 0; i < n; i++ {
+		e := tiff[int(offset)+2+12*i:]
+		tag, count := be.Uint16(e), be.Uint32(e[4:])
+		size := count
+		if be.Uint16(e[2:]) == typeLong {
+			size *= 4
+		}
+		value := e[8:12]
+		if size > 4 {
+			off := be.Uint32(e[8:])
+			value = tiff[off : off+size]
+		}
+		entries[tag] = value[:size]
+	}
+	return entries
+}
+
+// jpegTIFF returns the TIFF block of the EXIF segment of a JPEG.
+func jpegTIFF(t *testing.T, data []byte) []byte {
+	t.Helper()
+	for pos := 2; pos+4 <= len(data) && data[pos+1] != 0xDA; {
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if payload := data[pos+4 : end]; data[pos+1] == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			return payload[len(exifHeader):]
+		}
+		pos = end
+	}
+	t.Fatal("no EXIF segment")
+	return nil
+}
+
+func TestEmbedImageMetadataJPEG(t *testing.T) {
+	var src bytes.Buffer
+	if err := jpeg.Encode(&src, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	original, err := jpeg.Decode(bytes.NewReader(src.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := testMetadata("Trains 🚂 à Paris", "Zoë (@user)")
+	data, err := EmbedImageMetadata(src.Bytes(), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding image with metadata: %v", err)
+	}
+	if !reflect.DeepEqual(img, original) {
+		t.Error("pixels changed")
+	}
+
+	again, err := EmbedImageMetadata(data, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Error("embedding twice doesn't replace the first metadata")
+	}
+
+	tiff := jpegTIFF(t, data)
+	ifd0 := tiffEntries(t, tiff, binary.BigEndian.Uint32(tiff[4:]))
+	if _, ok := ifd0[tagImageDescription]; ok {
+		t.Error("non-ASCII description written as ImageDescription")
+	}
+	if _, ok := ifd0[tagArtist]; ok {
+		t.Error("non-ASCII artist written as Artist")
+	}
+	exif := tiffEntries(t, tiff, binary.BigEndian.Uint32(ifd0[tagExifIFD]))
+	if got := string(exif[tagDateTimeOriginal]); got != "2023:11:14 22:13:20\x00" {
+		t.Errorf("DateTimeOriginal = %q", got)
+	}
+	comment := exif[tagUserComment]
+	if !bytes.HasPrefix(comment, []byte("UNICODE\x00")) {
+		t.Fatalf("UserComment = %q, want a Unicode comment", comment)
+	}
+	units := make([]uint16, (len(comment)-8)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(comment[8+2*i:])
+	}
+	if got := string(utf16.Decode(units)); got != meta.Description {
+		t.Errorf("UserComment = %q, want %q", got, meta.Description)
+	}
+	if !bytes.Contains(data, []byte("Trains 🚂 à Paris")) || !bytes.Contains(data, []byte("Zoë (@user)")) {
+		t.Error("XMP doesn't hold the UTF-8 text")
+	}
+}
+
+func TestEmbedImageMetadataASCII(t *testing.T) {
+	var src bytes.Buffer
+	if err := jpeg.Encode(&src, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := EmbedImageMetadata(src.Bytes(), testMetadata("Trains in Paris", "Name (@user)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiff := jpegTIFF(t, data)
+	ifd0 := tiffEntries(t, tiff, binary.BigEndian.Uint32(tiff[4:]))
+	if got := string(ifd0[tagImageDescription]); got != "Trains in Paris\x00" {
+		t.Errorf("ImageDescription = %q", got)
+	}
+	if got := string(ifd0[tagArtist]); got != "Name (@user)\x00" {
+		t.Errorf("Artist = %q", got)
+	}
+}
+
+func TestEmbedImageMetadataPNG(t *testing.T) {
+	var src bytes.Buffer
+	if err := png.Encode(&src, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	original, err := png.Decode(bytes.NewReader(src.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := testMetadata("Trains 🚂", "@user")
+	data, err := EmbedImageMetadata(src.Bytes(), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding image with metadata: %v", err)
+	}
+	if !reflect.DeepEqual(img, original) {
+		t.Error("pixels changed")
+	}
+
+	again, err := EmbedImageMetadata(data, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Error("embedding twice doesn't replace the first metadata")
+	}
+	if n := strings.Count(string(data), "eXIf"); n != 1 {
+		t.Errorf("%d eXIf chunks, want 1", n)
+	}
+}
+
+func TestEmbedImageMetadataUnsupported(t *testing.T) {
+	if _, err := EmbedImageMetadata([]byte("GIF89a"), testMetadata("", "")); err == nil {
+		t.Error("no error for a GIF")
+	}
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+
+	twitterscraper "github.com/imperatrona/twitter-scraper"
+)
+
+// Values of -write-info-json.
+const (
+	InfoJSONMedia = "media"
+	InfoJSONTweet = "tweet"
+
+	infoJSONExt = ".info.json"
+)
+
+// TweetInfo is the content of an info-json sidecar: the tweet record and the
+// media saved from it.
+type TweetInfo struct {
+	ID             string      `json:"id"`
+	Permalink      string      `json:"permalink"`
+	Text           string      `json:"text"`
+	Author         UserInfo    `json:"author"`
+	Timestamp      int64       `json:"timestamp"`
+	Date           time.Time   `json:"date"`
+	ConversationID string      `json:"conversation_id,omitempty"`
+	Hashtags       []string    `json:"hashtags"`
+	Mentions       []UserInfo  `json:"mentions"`
+	URLs           []string    `json:"urls"`
+	Likes          int         `json:"likes"`
+	Retweets       int         `json:"retweets"`
+	Replies        int         `json:"replies"`
+	Views          int         `json:"views"`
+	Sensitive      bool        `json:"sensitive"`
+	IsReply        bool        `json:"is_reply"`
+	IsQuote        bool        `json:"is_quote"`
+	IsRetweet      bool        `json:"is_retweet"`
+	InReplyToID    string      `json:"in_reply_to_id,omitempty"`
+	QuotedID       string      `json:"quoted_id,omitempty"`
+	RetweetedID    string      `json:"retweeted_id,omitempty"`
+	Quoted         *TweetInfo  `json:"quoted,omitempty"`
+	Retweeted      *TweetInfo  `json:"retweeted,omitempty"`
+	Media          []MediaInfo `json:"media,omitempty"`
+	Downloaded     *time.Time  `json:"downloaded,omitempty"`
+}
+
+// UserInfo identifies the author or a mentioned user of a tweet.
+type UserInfo struct {
+	ID       string `json:"id,omitempty"`
+	Username string `json:"username"`
+	Name     string `json:"name,omitempty"`
+}
+
+// MediaInfo describes one saved media file of a tweet. File is its name, or
+// in `twmd export` its path, empty if it wasn't downloaded. AltText stays
+// empty while the scraper doesn't return alt texts.
+type MediaInfo struct {
+	Index   int    `json:"index"`
+	Type    string `json:"type"`
+	URL     string `json:"url"`
+	File    string `json:"file"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	Hash    string `json:"phash,omitempty"`
+	AltText string `json:"alt_text,omitempty"`
+}
+
+// NewTweetInfo converts a scraped tweet, with its quoted or retweeted tweet
+// one level deep.
+func NewTweetInfo(tweet *twitterscraper.Tweet) *TweetInfo {
+	info := tweetInfo(tweet)
+	if tweet.QuotedStatus != nil {
+		info.Quoted = tweetInfo(tweet.QuotedStatus)
+	}
+	if tweet.RetweetedStatus != nil {
+		info.Retweeted = tweetInfo(tweet.RetweetedStatus)
+	}
+	return info
+}
+
+func tweetInfo(tweet *twitterscraper.Tweet) *TweetInfo {
+	info := &TweetInfo{
+		ID:             tweet.ID,
+		Permalink:      tweet.PermanentURL,
+		Text:           tweet.Text,
+		Author:         UserInfo{ID: tweet.UserID, Username: tweet.Username, Name: tweet.Name},
+		Timestamp:      tweet.Timestamp,
+		Date:           time.Unix(tweet.Timestamp, 0).UTC(),
+		ConversationID: tweet.ConversationID,
+		Hashtags:       append([]string{}, tweet.Hashtags...),
+		URLs:           append([]string{}, tweet.URLs...),
+		Likes:          tweet.Likes,
+		Retweets:       tweet.Retweets,
+		Replies:        tweet.Replies,
+		Views:          tweet.Views,
+		Sensitive:      tweet.SensitiveContent,
+		IsReply:        tweet.IsReply,
+		IsQuote:        tweet.IsQuoted,
+		IsRetweet:      tweet.IsRetweet,
+		InReplyToID:    tweet.InReplyToStatusID,
+		QuotedID:       tweet.QuotedStatusID,
+		RetweetedID:    tweet.RetweetedStatusID,
+	}
+	info.Mentions = make([]UserInfo, len(tweet.Mentions))
+	for i, m := range tweet.Mentions {
+		info.Mentions[i] = UserInfo{ID: m.ID, Username: m.Username, Name: m.Name}
+	}
+	return info
+}
+
+func newMediaInfo(r MediaResult) MediaInfo {
+	info := MediaInfo{
+		Index:  r.Index,
+		Type:   r.Type,
+		URL:    r.URL,
+		File:   filepath.Base(r.Path),
+		Width:  r.Width,
+		Height: r.Height,
+		Bytes:  r.Bytes,
+	}
+	if r.Type == "img" && r.Status == MediaDownloaded {
+		info.Hash = formatHash(r.Hash)
+	}
+	return info
+}
+
+// infoJSONPath returns where the sidecar of a media file goes: next to it,
+// with .info.json replacing its extension.
+func infoJSONPath(mediaPath string) string {
+	return strings.TrimSuffix(mediaPath, filepath.Ext(mediaPath)) + infoJSONExt
+}
+
+// writeInfoJSON saves the sidecars of the media downloaded from tweet: one
+// per file, or with -write-info-json tweet a single <tweet id>.info.json in
+// the output directory listing them all.
+func (d *Downloader) writeInfoJSON(tweet *twitterscraper.Tweet, results []MediaResult) {
+	var saved []MediaResult
+	for _, r := range results {
+		if r.Status == MediaDownloaded {
+			saved = append(saved, r)
+		}
+	}
+	if len(saved) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	if d.config.WriteInfoJSON == InfoJSONTweet {
+		info := NewTweetInfo(tweet)
+		info.Downloaded = &now
+		for _, r := range saved {
+			info.Media = append(info.Media, newMediaInfo(r))
+		}
+		d.saveInfoJSON(filepath.Join(d.config.OutputDir, tweet.ID+infoJSONExt), info)
+		return
+	}
+
+	for _, r := range saved {
+		info := NewTweetInfo(tweet)
+		info.Downloaded = &now
+		info.Media = []MediaInfo{newMediaInfo(r)}
+		d.saveInfoJSON(infoJSONPath(r.Path), info)
+	}
+}
+
+func (d *Downloader) saveInfoJSON(path string, info *TweetInfo) {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(context.Background(), path, bytes.NewReader(data), 0644)
+	}
+	if err != nil {
+		d.log().Error("writing info json failed", "tweet_id", info.ID, "path", path, "error", err)
+		return
+	}
+	if d.config.SetMtime {
+		d.setMtime(path, time.Unix(info.Timestamp, 0))
+	}
+}
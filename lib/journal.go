@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const failedJournalFile = "twmd_failed.jsonl"
+
+// FailedItem is one line of the failed-items journal.
+type FailedItem struct {
+	TweetID     string    `json:"tweet_id"`
+	URL         string    `json:"url"`
+	Path        string    `json:"path"`
+	Type        string    `json:"type"`
+	ErrorClass  string    `json:"error_class"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+}
+
+func LoadFailedJournal(path string) ([]FailedItem, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []FailedItem
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var item FailedItem
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+func writeFailedJournal(path string, items []FailedItem) error {
+	if len(items) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(context.Background(), path, &buf, 0644)
+}
+
+// updateJournal merges the results of this run into the failed-items journal
+// in the output directory: new failures are added, repeated ones have their
+// attempt count bumped and media that made it this time are dropped.
+func (d *Downloader) updateJournal() error {
+	path := filepath.Join(d.config.OutputDir, failedJournalFile)
+	items, err := LoadFailedJournal(path)
+	if err != nil {
+		return err
+	}
+
+	byURL := make(map[string]int, len(items))
+	for i, item := range items {
+		byURL[item.URL] = i
+	}
+
+	d.resultsMu.Lock()
+	changed := false
+	for _, r := range d.results {
+		i, known := byURL[r.URL]
+		if r.Status != MediaFailed {
+			if known {
+				items[i].URL = ""
+				changed = true
+			}
+			continue
+		}
+
+		if !known {
+			items = append(items, FailedItem{TweetID: r.TweetID, URL: r.URL})
+			i = len(items) - 1
+			byURL[r.URL] = i
+		}
+		items[i].URL = r.URL
+		items[i].Path = r.Path
+		if abs, err := filepath.Abs(r.Path); err == nil {
+			items[i].Path = abs
+		}
+		items[i].Type = r.Type
+		items[i].ErrorClass = errorClass(r.Err)
+		items[i].Error = r.Err.Error()
+		items[i].Attempts++
+		items[i].LastAttempt = time.Now()
+		changed = true
+	}
+	d.resultsMu.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	remaining := items[:0]
+	for _, item := range items {
+		if item.URL != "" {
+			remaining = append(remaining, item)
+		}
+	}
+	return writeFailedJournal(path, remaining)
+}
+
+// errorClass buckets a download error for the journal.
+func errorClass(err error) string {
+	var status *StatusError
+	var netErr net.Error
+	var urlErr *url.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "interrupted"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrProtected):
+		return "forbidden"
+	case errors.As(err, &status):
+		if status.Code >= 500 {
+			return "server_error"
+		}
+		return fmt.Sprintf("http_%d", status.Code)
+	case err != nil && strings.Contains(err.Error(), "transfer stalled"):
+		return "stalled"
+	case errors.As(err, &netErr), errors.As(err, &urlErr):
+		return "network"
+	case errors.Is(err, os.ErrPermission), errors.Is(err, os.ErrNotExist):
+		return "filesystem"
+	default:
+		return "other"
+	}
+}
+
+// RunRetryFailed implements `twmd retry-failed DIR`: it downloads again the
+// media listed in the folder's failed-items journal, without scraping. No new
+// item is started once stop is cancelled; abort also cancels the running one.
+func RunRetryFailed(stop, abort context.Context, args []string) (Summary, error) {
+	cfg := &Config{Size: "large", Transport: DefaultTransportOptions}
+	flags := flag.NewFlagSet("retry-failed", flag.ExitOnError)
+	flags.StringVar(&cfg.Proxy, "proxy", "", "Use proxy (http|https|socks5://[user:pass@]ip:port)")
+	var proxyFile, limitRate, limitSchedule string
+	flags.StringVar(&proxyFile, "proxy-file", "", "File with one proxy per line to rotate between")
+	flags.StringVar(&cfg.ProxyStrategy, "proxy-strategy", ProxyRoundRobin, "How to pick from -proxy-file: rr (round-robin) or lru (least recently used)")
+	flags.DurationVar(&cfg.ProxyCooldown, "proxy-cooldown", time.Minute, "How long a failing or rate limited proxy is left out before it is probed again (doubles on repeated failures)")
+	flags.StringVar(&limitRate, "limit-rate", "", "Maximum combined download rate, e.g. 500K or 2M (bytes/s)")
+	flags.StringVar(&limitSchedule, "limit-schedule", "", "Time of day rate limits overriding -limit-rate, e.g. \"09:00-18:00=1M,18:00-09:00=0\" (0 = unlimited)")
+	maxAttempts := flags.Int("max-attempts", 0, "Skip items that already failed this many times, 0 for no limit")
+	flags.DurationVar(&cfg.Transport.StallTimeout, "stall-timeout", DefaultTransportOptions.StallTimeout, "Abort a transfer when no data arrives for this long, 0 to disable")
+	addLogFlags(flags, cfg)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: twmd retry-failed [options] DIR\n\nDownload again the media listed in DIR/%s.\n\n", failedJournalFile)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		quitWithError(flags, "You must specify the user folder holding the journal")
+	}
+	parseTransferFlags(flags, cfg, proxyFile, limitRate, limitSchedule)
+	if err := cfg.Validate(); err != nil {
+		var cerr *ConfigError
+		if errors.As(err, &cerr) {
+			quitWithError(flags, "Error in "+cerr.Field+": "+cerr.Msg)
+		}
+		return Summary{}, err
+	}
+	cfg.OutputDir = flags.Arg(0)
+
+	logger, logFile, err := OpenLogger(cfg, os.Stderr)
+	if err != nil {
+		return Summary{}, err
+	}
+	defer logFile.Close()
+	cfg.Logger = logger
+
+	items, err := LoadFailedJournal(filepath.Join(cfg.OutputDir, failedJournalFile))
+	if err != nil {
+		return Summary{}, err
+	}
+	if *maxAttempts > 0 {
+		retry := items[:0]
+		for _, item := range items {
+			if item.Attempts < *maxAttempts {
+				retry = append(retry, item)
+				continue
+			}
+			logger.Debug("skipping item, too many attempts", "tweet_id", item.TweetID, "url", item.URL, "attempts", item.Attempts)
+		}
+		items = retry
+	}
+	if len(items) == 0 {
+		logger.Info("nothing to retry", "dir", cfg.OutputDir)
+		return Summary{}, nil
+	}
+
+	var httpClient HTTPClient
+	if len(cfg.ProxyList) > 0 {
+		httpClient, err = NewProxyPool(cfg.ProxyList, cfg.ProxyStrategy, cfg.ProxyCooldown, cfg.Transport)
+	} else {
+		httpClient, err = NewHTTPClient(cfg.Proxy, cfg.Transport)
+	}
+	if err != nil {
+		return Summary{}, err
+	}
+	d := NewDownloader(cfg, httpClient)
+
+	for _, item := range items {
+		if stop.Err() != nil {
+			break
+		}
+		logger.Debug("retrying", "tweet_id", item.TweetID, "url", item.URL, "attempt", item.Attempts+1)
+		d.fetch(abort, mediaItem{
+			tweetID:  item.TweetID,
+			url:      item.URL,
+			name:     filepath.Base(item.Path),
+			fileType: item.Type,
+			path:     item.Path,
+		})
+	}
+
+	if err := d.updateJournal(); err != nil {
+		return d.summary(), fmt.Errorf("error updating %s: %w", failedJournalFile, err)
+	}
+	return d.summary(), stop.Err()
+}
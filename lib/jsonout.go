@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONEvent is one line of the -json output. Event is one of tweet,
+// planned, downloaded, skipped, failed and, last, summary.
+type JSONEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	TweetID    string    `json:"tweet_id,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	URL        string    `json:"url,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Type       string    `json:"type,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"error_class,omitempty"`
+	Summary    *Summary  `json:"summary,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+}
+
+// JSONWriter writes events as newline-delimited JSON.
+type JSONWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &JSONWriter{enc: enc}
+}
+
+// Hook writes e; register it with AddHook.
+func (j *JSONWriter) Hook(e Event) {
+	out := JSONEvent{Time: time.Now()}
+	switch e.Type {
+	case EventTweet:
+		out.Event = "tweet"
+		out.TweetID = e.Tweet.ID
+		out.Author = e.Tweet.Username
+		out.URL = e.Tweet.PermanentURL
+	case EventMediaPlanned, EventMediaFinished, EventMediaSkipped, EventMediaFailed:
+		r := e.Media
+		out.Event = r.Status.String()
+		out.TweetID = r.TweetID
+		out.Author = r.Username
+		out.URL = r.URL
+		out.Path = r.Path
+		out.Type = r.Type
+		out.Bytes = r.Bytes
+		if r.Status == MediaDownloaded && r.Type == "img" {
+			out.Hash = formatHash(r.Hash)
+		}
+		if r.Err != nil {
+			out.Error = r.Err.Error()
+			if r.Status == MediaFailed {
+				out.ErrorClass = errorClass(r.Err)
+			}
+		}
+	default:
+		return
+	}
+	j.write(out)
+}
+
+// WriteSummary writes the final summary line.
+func (j *JSONWriter) WriteSummary(s Summary, exitCode int) {
+	j.write(JSONEvent{Event: "summary", Time: time.Now(), Summary: &s, ExitCode: &exitCode})
+}
+
+// formatHash formats an image hash as 16 hex digits.
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func (j *JSONWriter) write(e JSONEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(e)
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// NewLogger returns a logger writing records of at least level to w, as
+// key=value text or, with json, as one JSON object per line.
+func NewLogger(w io.Writer, level slog.Leveler, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// OpenLogger builds the logger selected by the -v, -q, -log-format and
+// -log-file flags. Records go to w and, with -log-file, are appended to that
+// file too; close the returned file when done.
+func OpenLogger(cfg *Config, w io.Writer) (*slog.Logger, io.Closer, error) {
+	level := slog.LevelInfo
+	switch {
+	case cfg.Verbose:
+		level = slog.LevelDebug
+	case cfg.Quiet:
+		level = slog.LevelWarn
+	}
+
+	var closer io.Closer = io.NopCloser(nil)
+	if cfg.LogFile != "" {
+		f, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening log file: %w", err)
+		}
+		w = io.MultiWriter(w, f)
+		closer = f
+	}
+	return NewLogger(w, level, cfg.LogFormat == "json"), closer, nil
+}
+
+// addLogFlags registers the flags OpenLogger reads on flags.
+func addLogFlags(flags *flag.FlagSet, cfg *Config) {
+	flags.BoolVar(&cfg.Verbose, "v", false, "Verbose: log every request with its details")
+	flags.BoolVar(&cfg.Quiet, "q", false, "Quiet: only log warnings and errors")
+	flags.StringVar(&cfg.LogFormat, "log-format", "text", "Format of log records on stderr: text or json")
+	flags.StringVar(&cfg.LogFile, "log-file", "", "Also append log records to this file")
+}
+
+// LogSink is an io.Writer for log handlers whose destination can be changed
+// while records are written, e.g. to print them above a live ProgressView.
+type LogSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewLogSink(w io.Writer) *LogSink {
+	return &LogSink{w: w}
+}
+
+func (s *LogSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+func (s *LogSink) SetOutput(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w = w
+}
+
+// stdout returns where the Config's plain output goes, os.Stdout by default.
+func (cfg *Config) stdout() io.Writer {
+	if cfg.Stdout != nil {
+		return cfg.Stdout
+	}
+	return os.Stdout
+}
+
+// logger returns the Config's logger, or one that discards everything.
+func (cfg *Config) logger() *slog.Logger {
+	if cfg.Logger != nil {
+		return cfg.Logger
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// maxMoovSize bounds the movie box read into memory; the media data is never
+// loaded.
+const maxMoovSize = 64 << 20
+
+// mp4Box is a box of an MP4 file: its type, where it starts and its total
+// size including the header.
+type mp4Box struct {
+	typ    string
+	offset int64
+	size   int64
+	header int64
+}
+
+// readMP4Boxes lists the boxes between start and end of r.
+func readMP4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	var hdr [16]byte
+	for pos := start; pos < end; {
+		if end-pos < 8 {
+			return nil, errors.New("truncated MP4 box")
+		}
+		if _, err := r.ReadAt(hdr[:8], pos); err != nil {
+			return nil, fmt.Errorf("error reading MP4 box: %w", err)
+		}
+		box := mp4Box{typ: string(hdr[4:8]), offset: pos, size: int64(binary.BigEndian.Uint32(hdr[:4])), header: 8}
+		switch box.size {
+		case 0:
+			// Extends to the end of the file.
+			box.size = end - pos
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], pos+8); err != nil {
+				return nil, fmt.Errorf("error reading MP4 box: %w", err)
+			}
+			box.size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			box.header = 16
+		}
+		if box.size < box.header || box.size > end-pos {
+			return nil, fmt.Errorf("invalid size of MP4 box %q", box.typ)
+		}
+		boxes = append(boxes, box)
+		pos += box.size
+	}
+	return boxes, nil
+}
+
+// encodeMP4Box returns a box of type typ holding the concatenated payloads.
+func encodeMP4Box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], typ)
+	for _, p := range payloads {
+		box = append(box, p...)
+	}
+	return box
+}
+
+// EmbedVideoMetadata returns the MP4 file r of the given size with meta
+// written as iTunes-style moov/udta/meta atoms, replacing the ones it had.
+// Only the movie box is rewritten; when it comes before the media data, the
+// chunk offsets are moved by the change of its size. The returned reader
+// reads the media data from r as it goes.
+func EmbedVideoMetadata(r io.ReaderAt, size int64, meta *MediaMetadata) (io.Reader, error) {
+	boxes, err := readMP4Boxes(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	var moov *mp4Box
+	for i, box := range boxes {
+		switch box.typ {
+		case "moov":
+			moov = &boxes[i]
+		case "moof":
+			return nil, errors.New("fragmented MP4 is not supported")
+		}
+	}
+	if moov == nil {
+		return nil, errors.New("no moov box")
+	}
+	if moov.size > maxMoovSize {
+		return nil, errors.New("moov box too large")
+	}
+
+	data := make([]byte, moov.size)
+	if _, err := r.ReadAt(data, moov.offset); err != nil {
+		return nil, fmt.Errorf("error reading moov box: %w", err)
+	}
+	newMoov, err := rewriteMoov(data[moov.header:], meta)
+	if err != nil {
+		return nil, err
+	}
+
+	moovEnd := moov.offset + moov.size
+	if delta := int64(len(newMoov)) - moov.size; delta != 0 {
+		if err := shiftChunkOffsets(newMoov[8:], moovEnd, delta); err != nil {
+			return nil, err
+		}
+	}
+	return io.MultiReader(
+		io.NewSectionReader(r, 0, moov.offset),
+		bytes.NewReader(newMoov),
+		io.NewSectionReader(r, moovEnd, size-moovEnd),
+	), nil
+}
+
+// rewriteMoov returns a moov box with the children of payload, udta last and
+// with its meta box replaced.
+func rewriteMoov(payload []byte, meta *MediaMetadata) ([]byte, error) {
+	r := bytes.NewReader(payload)
+	children, err := readMP4Boxes(r, 0, int64(len(payload)))
+	if err != nil {
+		return nil, err
+	}
+
+	var parts [][]byte
+	var udta [][]byte
+	for _, c := range children {
+		box := payload[c.offset : c.offset+c.size]
+		if c.typ != "udta" {
+			parts = append(parts, box)
+			continue
+		}
+		inner := box[c.header:]
+		udtaChildren, err := readMP4Boxes(bytes.NewReader(inner), 0, int64(len(inner)))
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range udtaChildren {
+			if u.typ != "meta" {
+				udta = append(udta, inner[u.offset:u.offset+u.size])
+			}
+		}
+	}
+	udta = append(udta, encodeMetaBox(meta))
+	parts = append(parts, encodeMP4Box("udta", udta...))
+	return encodeMP4Box("moov", parts...), nil
+}
+
+// encodeMetaBox returns the meta box with an ilst of the tags players show.
+func encodeMetaBox(meta *MediaMetadata) []byte {
+	var tags [][]byte
+	add := func(typ, value string) {
+		if value == "" {
+			return
+		}
+		// Well-known type 1 is UTF-8 text, followed by a zero locale.
+		data := encodeMP4Box("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte(value))
+		tags = append(tags, encodeMP4Box(typ, data))
+	}
+	add("\xa9nam", meta.Title)
+	add("\xa9ART", meta.Artist)
+	if !meta.Date.IsZero() {
+		add("\xa9day", meta.Date.Format(time.RFC3339))
+	}
+	add("\xa9cmt", meta.Source)
+	add("desc", meta.Description)
+	add("ldes", meta.Description)
+
+	// Version and flags, pre_defined, handler type, three reserved words and
+	// an empty name.
+	hdlr := make([]byte, 25)
+	copy(hdlr[8:], "mdirappl")
+	fullBox := []byte{0, 0, 0, 0}
+	return encodeMP4Box("meta", fullBox, encodeMP4Box("hdlr", hdlr), encodeMP4Box("ilst", tags...))
+}
+
+// shiftChunkOffsets adds delta to the chunk offsets at or past moovEnd in the
+// stco and co64 boxes found under the moov payload.
+func shiftChunkOffsets(payload []byte, moovEnd, delta int64) error {
+	boxes, err := readMP4Boxes(bytes.NewReader(payload), 0, int64(len(payload)))
+	if err != nil {
+		return err
+	}
+	be := binary.BigEndian
+	for _, box := range boxes {
+		inner := payload[box.offset+box.header : box.offset+box.size]
+		switch box.typ {
+		case "trak", "mdia", "minf", "stbl":
+			if err := shiftChunkOffsets(inner, moovEnd, delta); err != nil {
+				return err
+			}
+		case "stco", "co64":
+			width := 4
+			if box.typ == "co64" {
+				width = 8
+			}
+			if len(inner) < 8 {
+				return fmt.Errorf("truncated %s box", box.typ)
+			}
+			count := int(be.Uint32(inner[4:]))
+			if count > (len(inner)-8)/width {
+				return fmt.Errorf("truncated %s box", box.typ)
+			}
+			for i := 0; i < count; i++ {
+				entry := inner[8+i*width:]
+				if width == 8 {
+					if off := int64(be.Uint64(entry)); off >= moovEnd {
+						be.PutUint64(entry, uint64(off+delta))
+					}
+					continue
+				}
+				off := int64(be.Uint32(entry))
+				if off < moovEnd {
+					continue
+				}
+				if off+delta > 0xFFFFFFFF {
+					return errors.New("chunk offset overflows stco")
+				}
+				be.PutUint32(entry, uint32(off+delta))
+			}
+		}
+	}
+	return nil
+}
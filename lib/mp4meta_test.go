@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testChunks = []string{"first chunk", "second chunk", "third"}
+
+// buildTestMP4 returns an MP4 file with one track whose chunks are
+// testChunks, indexed by an stco or, with co64, a co64 box. extra boxes are
+// added to the moov.
+func buildTestMP4(moovFirst, co64 bool, extra ...[]byte) []byte {
+	ftyp := encodeMP4Box("ftyp", []byte("isom\x00\x00\x02\x00isommp41"))
+	mdatPayload := []byte(strings.Join(testChunks, ""))
+	mdat := encodeMP4Box("mdat", mdatPayload)
+
+	moov := func(mdatOffset int) []byte {
+		typ, width := "stco", 4
+		if co64 {
+			typ, width = "co64", 8
+		}
+		table := make([]byte, 8, 8+width*len(testChunks))
+		binary.BigEndian.PutUint32(table[4:], uint32(len(testChunks)))
+		offset := mdatOffset + 8
+		for _, c := range testChunks {
+			if co64 {
+				table = binary.BigEndian.AppendUint64(table, uint64(offset))
+			} else {
+				table = binary.BigEndian.AppendUint32(table, uint32(offset))
+			}
+			offset += len(c)
+		}
+		stbl := encodeMP4Box("stbl", encodeMP4Box(typ, table))
+		trak := encodeMP4Box("trak", encodeMP4Box("mdia", encodeMP4Box("minf", stbl)))
+		mvhd := encodeMP4Box("mvhd", make([]byte, 100))
+		return encodeMP4Box("moov", append([][]byte{mvhd, trak}, extra...)...)
+	}
+
+	if moovFirst {
+		m := moov(0)
+		return bytes.Join([][]byte{ftyp, moov(len(ftyp) + len(m)), mdat}, nil)
+	}
+	return bytes.Join([][]byte{ftyp, mdat, moov(len(ftyp))}, nil)
+}
+
+// findMP4Box returns the payload of the first box at path, e.g.
+// moov/udta/meta, in data.
+func findMP4Box(t *testing.T, data []byte, path string) []byte {
+	t.Helper()
+	typ, rest, _ := strings.Cut(path, "/")
+	boxes, err := readMP4Boxes(bytes.NewReader(data), 0, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, box := range boxes {
+		if box.typ != typ {
+			continue
+		}
+		payload := data[box.offset+box.header : box.offset+box.size]
+		if rest == "" {
+			return payload
+		}
+		if typ == "meta" {
+			// A full box: version and flags come before the children.
+			payload = payload[4:]
+		}
+		return findMP4Box(t, payload, rest)
+	}
+	t.Fatalf("no %s box", typ)
+	return nil
+}
+
+// checkChunks checks that the chunk offsets of the MP4 file data point to
+// testChunks.
+func checkChunks(t *testing.T, data []byte, co64 bool) {
+	t.Helper()
+	typ, width := "stco", 4
+	if co64 {
+		typ, width = "co64", 8
+	}
+	table := findMP4Box(t, data, "moov/trak/mdia/minf/stbl/"+typ)
+	if n := int(binary.BigEndian.Uint32(table[4:])); n != len(testChunks) {
+		t.Fatalf("%d chunk offsets, want %d", n, len(testChunks))
+	}
+	for i, c := range testChunks {
+		var offset int
+		if co64 {
+			offset = int(binary.BigEndian.Uint64(table[8+i*width:]))
+		} else {
+			offset = int(binary.BigEndian.Uint32(table[8+i*width:]))
+		}
+		if offset+len(c) > len(data) || string(data[offset:offset+len(c)]) != c {
+			t.Errorf("chunk %d at %d doesn't point to %q", i, offset, c)
+		}
+	}
+}
+
+func embedTestMP4(t *testing.T, data []byte, meta *MediaMetadata) []byte {
+	t.Helper()
+	r, err := EmbedVideoMetadata(bytes.NewReader(data), int64(len(data)), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestEmbedVideoMetadata(t *testing.T) {
+	meta := &MediaMetadata{
+		Title:       "Trains 🚂",
+		Artist:      "@user",
+		Description: "Trains 🚂 in Paris",
+		Source:      "https://twitter.com/user/status/1",
+		Date:        time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+	}
+	tests := []struct {
+		name      string
+		moovFirst bool
+		co64      bool
+	}{
+		{"moov first, stco", true, false},
+		{"moov first, co64", true, true},
+		{"moov last, stco", false, false},
+		{"moov last, co64", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := buildTestMP4(tt.moovFirst, tt.co64)
+			checkChunks(t, src, tt.co64)
+
+			out := embedTestMP4(t, src, meta)
+			checkChunks(t, out, tt.co64)
+			ilst := findMP4Box(t, out, "moov/udta/meta/ilst")
+			if !bytes.Contains(findMP4Box(t, ilst, "\xa9nam"), []byte(meta.Title)) {
+				t.Error("no title in ilst")
+			}
+			if !bytes.Contains(findMP4Box(t, ilst, "desc"), []byte(meta.Description)) {
+				t.Error("no description in ilst")
+			}
+
+			again := embedTestMP4(t, out, meta)
+			if !bytes.Equal(again, out) {
+				t.Error("embedding twice doesn't replace the first metadata")
+			}
+		})
+	}
+}
+
+func TestEmbedVideoMetadataKeepsUdta(t *testing.T) {
+	udta := encodeMP4Box("udta", encodeMP4Box("cprt", []byte("keep me")), encodeMP4Box("meta", []byte{0, 0, 0, 0}))
+	src := buildTestMP4(true, false, udta)
+	out := embedTestMP4(t, src, &MediaMetadata{Title: "title"})
+	checkChunks(t, out, false)
+
+	if !bytes.Contains(findMP4Box(t, out, "moov/udta/cprt"), []byte("keep me")) {
+		t.Error("other udta boxes were dropped")
+	}
+	if n := bytes.Count(out, []byte("meta")); n != 1 {
+		t.Errorf("%d meta boxes, want 1", n)
+	}
+}
+
+func TestEmbedVideoMetadataErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no moov", encodeMP4Box("ftyp", []byte("isom"))},
+		{"fragmented", bytes.Join([][]byte{buildTestMP4(true, false), encodeMP4Box("moof")}, nil)},
+		{"truncated", buildTestMP4(true, false)[:40]},
+	}
+	for _, tt := range tests {
+		if _, err := EmbedVideoMetadata(bytes.NewReader(tt.data), int64(len(tt.data)), &MediaMetadata{}); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
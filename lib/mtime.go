@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// setMtime sets the modification time of a saved file to posted, the time of
+// its tweet, and notes its directories for applyDirTimes.
+func (d *Downloader) setMtime(path string, posted time.Time) {
+	if err := os.Chtimes(path, posted, posted); err != nil {
+		d.log().Warn("setting modification time failed", "path", path, "error", err)
+		return
+	}
+
+	d.dirsMu.Lock()
+	defer d.dirsMu.Unlock()
+	if d.dirs == nil {
+		d.dirs = make(map[string]bool)
+	}
+	// Folders are dated up to the user folder, or with a custom output
+	// template up to the output directory, which itself is left alone.
+	root := filepath.Clean(d.config.OutputDir)
+	base := filepath.Dir(root)
+	if d.config.OutputBase != "" {
+		base = filepath.Clean(d.config.OutputBase)
+	}
+	for dir := filepath.Dir(path); dir != base && within(dir, base); dir = filepath.Dir(dir) {
+		d.dirs[dir] = true
+		if dir == root {
+			break
+		}
+	}
+}
+
+// within reports whether path is inside dir.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// applyDirTimes sets the modification time of every directory noted by
+// setMtime to that of the newest file or directory in it. With -set-mtime
+// that is the time of its newest tweet. twmd's own files, named twmd_*, and
+// hidden files are left out.
+func (d *Downloader) applyDirTimes() {
+	d.dirsMu.Lock()
+	dirs := make([]string, 0, len(d.dirs))
+	for dir := range d.dirs {
+		dirs = append(dirs, dir)
+	}
+	d.dirsMu.Unlock()
+
+	// Deepest first, so that parents see the new times of their children.
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		newest, err := newestEntry(dir)
+		if err != nil {
+			d.log().Warn("setting modification time failed", "path", dir, "error", err)
+			continue
+		}
+		if newest.IsZero() {
+			continue
+		}
+		if err := os.Chtimes(dir, newest, newest); err != nil {
+			d.log().Warn("setting modification time failed", "path", dir, "error", err)
+		}
+	}
+}
+
+func newestEntry(dir string) (time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var newest time.Time
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || strings.HasPrefix(e.Name(), "twmd_") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	twitterscraper "github.com/imperatrona/twitter-scraper"
+)
+
+// DefaultOutputTemplate is the layout of downloads without -output-template:
+// a folder per user with img and video folders.
+const DefaultOutputTemplate = "{USER}/{TYPE}/{FILENAME}"
+
+// mediaFile is what templates are expanded for: one media file of a tweet
+// downloaded while crawling user.
+type mediaFile struct {
+	tweetMediaFile
+	tweet *twitterscraper.Tweet
+	user  string
+	// filename is the name the file gets with the default template, see
+	// Downloader.generateFileName.
+	filename string
+	datefmt  string
+	// byAuthor makes the tweet tokens describe the original of a retweet, as
+	// in output templates; file formats describe the tweet itself.
+	byAuthor bool
+}
+
+// author is the tweet the media belongs to: for a retweet, the original.
+func (m *mediaFile) author() *twitterscraper.Tweet {
+	if m.tweet.RetweetedStatus != nil {
+		return m.tweet.RetweetedStatus
+	}
+	return m.tweet
+}
+
+// subject is the tweet the tweet tokens describe.
+func (m *mediaFile) subject() *twitterscraper.Tweet {
+	if m.byAuthor {
+		return m.author()
+	}
+	return m.tweet
+}
+
+func (m *mediaFile) date() time.Time {
+	return time.Unix(m.subject().Timestamp, 0)
+}
+
+// cdnName is the base name of the media URL, without query.
+func (m *mediaFile) cdnName() string {
+	name, _, _ := strings.Cut(path.Base(m.url), "?")
+	return name
+}
+
+func (m *mediaFile) ext() string {
+	return path.Ext(m.cdnName())
+}
+
+// OutputTemplate places downloaded media: a slash-separated path relative to
+// the output directory, with tokens replaced for each file. See
+// ParseOutputTemplate.
+type OutputTemplate struct {
+	t *Template
+}
+
+// ParseOutputTemplate checks the template s, written in the language of
+// Template. Its tokens describe the tweet, or for a retweet the original one;
+// {USER} is the user being downloaded and {FILENAME} the name given with the
+// default template, after -file-format.
+func ParseOutputTemplate(s string) (*OutputTemplate, error) {
+	if s == "" {
+		return nil, errors.New("empty template")
+	}
+	if strings.HasPrefix(s, "/") || strings.Contains(s, "\\") {
+		return nil, errors.New("must be a relative path with / separators")
+	}
+	for _, elem := range strings.Split(s, "/") {
+		if elem == ".." {
+			return nil, errors.New("must not contain ..")
+		}
+	}
+
+	t, err := parseTemplate(s)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Uses("FILENAME") && !t.Uses("FILE") && !t.Uses("MEDIA_ID") && !(t.Uses("ID") && t.Uses("INDEX")) {
+		return nil, errors.New("must include {FILENAME}, {FILE}, {MEDIA_ID} or {ID} with {INDEX} so that every file gets its own name")
+	}
+	return &OutputTemplate{t: t}, nil
+}
+
+var (
+	pathInvalidChars = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]`)
+	pathSeparators   = regexp.MustCompile(`[/\\]`)
+)
+
+// Expand returns the slash-separated path of m. Token values can't add
+// folders: separators and characters invalid in file names become _. The
+// name of {FILENAME} is only stripped of separators, to stay as it was before
+// templates.
+func (t *OutputTemplate) Expand(m *mediaFile) string {
+	file := *m
+	file.byAuthor = true
+	expanded := t.t.execute(&file, func(name, value string) string {
+		if name == "FILENAME" {
+			value = pathSeparators.ReplaceAllString(value, "_")
+		} else {
+			value = pathInvalidChars.ReplaceAllString(value, "_")
+		}
+		if value == "." || value == ".." {
+			value = "_"
+		}
+		return value
+	})
+	// Empty tokens leave empty folder names, e.g. {USER} for a single tweet.
+	return strings.TrimPrefix(path.Clean("/"+expanded), "/")
+}
+
+func (t *OutputTemplate) String() string {
+	return t.t.String()
+}
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Twitter's API rate limits reset every 15 minutes.
+	rateLimitWindow = 15 * time.Minute
+	maxPaceDelay    = 30 * time.Second
+	maxRateWaits    = 8
+)
+
+// Pacer spaces out scraper API calls. The delay between calls grows every
+// time Twitter answers with a rate limit and slowly shrinks back while
+// requests succeed, so long crawls slow down instead of failing.
+type Pacer struct {
+	mu          sync.Mutex
+	minDelay    time.Duration
+	delay       time.Duration
+	last        time.Time
+	windowStart time.Time
+	strikes     int
+
+	// rotate, if set, is offered rate limits and connection errors first. It
+	// reports whether it switched to a fresh proxy, in which case the call is
+	// retried right away.
+	rotate       func(error) bool
+	maxRotations int
+
+	logger *slog.Logger
+}
+
+func NewPacer(minDelay time.Duration, logger *slog.Logger) *Pacer {
+	return &Pacer{
+		minDelay: minDelay,
+		delay:    minDelay,
+		logger:   logger,
+	}
+}
+
+// Do calls fn once the current delay has passed since the previous call. If
+// fn fails with a rate limit, Do waits for the limit window to reset and tries
+// again, up to maxRateWaits times. what describes the call in log messages.
+// Cancelling ctx interrupts the waits, not a call already in progress.
+func (p *Pacer) Do(ctx context.Context, what string, fn func() error) error {
+	rotations := 0
+	for attempt := 1; ; attempt++ {
+		if err := p.wait(ctx); err != nil {
+			return err
+		}
+		start := time.Now()
+		err := fn()
+		p.logger.Debug(what, "attempt", attempt, "duration", time.Since(start), "error", err)
+		if p.rotate != nil && rotations < p.maxRotations && (errors.Is(err, ErrRateLimited) || isConnectionError(err)) {
+			if p.rotate(err) {
+				rotations++
+				attempt--
+				continue
+			}
+		}
+		if err == nil {
+			p.succeeded()
+			return nil
+		}
+		if !errors.Is(err, ErrRateLimited) {
+			return err
+		}
+		if attempt > maxRateWaits {
+			return err
+		}
+
+		wait := p.limited()
+		p.logger.Warn("rate limited, waiting for the limit to reset", "call", what,
+			"wait", wait.Round(time.Second), "attempt", attempt, "max_attempts", maxRateWaits)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Pacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	now := time.Now()
+	if p.windowStart.IsZero() || now.Sub(p.windowStart) > rateLimitWindow {
+		p.windowStart = now
+	}
+	next := p.last.Add(p.delay)
+	if next.Before(now) {
+		next = now
+	}
+	p.last = next
+	p.mu.Unlock()
+
+	return sleep(ctx, time.Until(next))
+}
+
+// sleep pauses for d or until ctx is cancelled, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pacer) succeeded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.strikes = 0
+	p.delay = max(p.delay*9/10, p.minDelay)
+}
+
+// limited records a rate limit response and returns how long to sleep. The
+// reset time isn't exposed by the scraper, so it is estimated from the start
+// of the current window, backing off exponentially when limits repeat.
+func (p *Pacer) limited() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.strikes++
+	old := p.delay
+	p.delay = min(max(p.delay*2, time.Second), maxPaceDelay)
+	if p.delay != old {
+		p.logger.Info("slowing down", "delay", p.delay)
+	}
+
+	wait := time.Until(p.windowStart.Add(rateLimitWindow))
+	backoff := time.Minute << (p.strikes - 1)
+	wait = min(max(wait, backoff), rateLimitWindow)
+
+	p.windowStart = time.Now().Add(wait)
+	return wait
+}
+
+func isConnectionError(err error) bool {
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
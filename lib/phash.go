@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const hashIndexFile = "twmd_phash.tsv"
+
+// DHash computes a 64-bit difference hash of img. The image is reduced to a
+// 9x8 grayscale grid and each bit records whether a cell is brighter than its
+// right-hand neighbour, which survives re-encoding and resizing.
+func DHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	var grid [h][w]float64
+
+	b := img.Bounds()
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/h, y0+1)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(b.Min.X+(x+1)*b.Dx()/w, x0+1)
+			grid[y][x] = averageLuma(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// averageLuma samples at most 16x16 pixels of the cell so large originals
+// don't cost a full pass over every pixel.
+func averageLuma(img image.Image, x0, y0, x1, y1 int) float64 {
+	stepX := max((x1-x0)/16, 1)
+	stepY := max((y1-y0)/16, 1)
+
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// HashImage decodes a JPEG, PNG or GIF and returns its DHash.
+func HashImage(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, err
+	}
+	return DHash(img), nil
+}
+
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// HashIndex maps image file names to their perceptual hash. It is backed by
+// an append-only tab separated file so concurrent downloads only ever add a
+// line.
+type HashIndex struct {
+	mu     sync.Mutex
+	path   string
+	hashes map[string]uint64
+	// reserved holds the hashes of images being saved, see MatchOrReserve.
+	reserved map[string]uint64
+}
+
+func LoadHashIndex(path string) (*HashIndex, error) {
+	idx := &HashIndex{
+		path:   path,
+		hashes: make(map[string]uint64),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		hex, name, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+		hash, err := strconv.ParseUint(hex, 16, 64)
+		if err != nil {
+			continue
+		}
+		idx.hashes[name] = hash
+	}
+	return idx, scanner.Err()
+}
+
+func (idx *HashIndex) Lookup(name string) (uint64, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	hash, ok := idx.hashes[name]
+	return hash, ok
+}
+
+// Match returns the name of an indexed or reserved image within threshold
+// bits of hash.
+func (idx *HashIndex) Match(hash uint64, threshold int) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.match(hash, threshold)
+}
+
+func (idx *HashIndex) match(hash uint64, threshold int) (string, bool) {
+	for _, hashes := range []map[string]uint64{idx.hashes, idx.reserved} {
+		for name, h := range hashes {
+			if HammingDistance(hash, h) <= threshold {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// MatchOrReserve is Match, except that when no image matches it reserves
+// name with hash in the same step, so that concurrent near-duplicates match
+// it while it is saved. The reservation ends with Add or Release.
+func (idx *HashIndex) MatchOrReserve(name string, hash uint64, threshold int) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if similar, ok := idx.match(hash, threshold); ok {
+		return similar, true
+	}
+	if idx.reserved == nil {
+		idx.reserved = make(map[string]uint64)
+	}
+	idx.reserved[name] = hash
+	return "", false
+}
+
+// Release drops the reservation of name, e.g. when saving it failed.
+func (idx *HashIndex) Release(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.reserved, name)
+}
+
+func (idx *HashIndex) Add(name string, hash uint64) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	f, err := os.OpenFile(idx.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%016x\t%s\n", hash, name); err != nil {
+		return err
+	}
+	delete(idx.reserved, name)
+	idx.hashes[name] = hash
+	return nil
+}
+
+// GroupSimilar clusters the images whose hashes are within threshold bits of
+// each other, transitively. Only groups with more than one member are
+// returned.
+func GroupSimilar(images map[string]uint64, threshold int) [][]string {
+	names := make([]string, 0, len(images))
+	hashes := make([]uint64, 0, len(images))
+	for name, hash := range images {
+		names = append(names, name)
+		hashes = append(hashes, hash)
+	}
+
+	parent := make([]int, len(names))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if HammingDistance(hashes[i], hashes[j]) <= threshold {
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+
+	byRoot := make(map[int][]string)
+	for i, name := range names {
+		root := find(i)
+		byRoot[root] = append(byRoot[root], name)
+	}
+
+	var groups [][]string
+	for _, group := range byRoot {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
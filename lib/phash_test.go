@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHashIndexMatchOrReserve(t *testing.T) {
+	idx, err := LoadHashIndex(filepath.Join(t.TempDir(), hashIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Near-duplicates saved concurrently: only one may go through.
+	var reserved atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, ok := idx.MatchOrReserve(fmt.Sprintf("%d.jpg", i), 0xFF00FF00FF00FF00^uint64(i&3), 4); !ok {
+				reserved.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := reserved.Load(); n != 1 {
+		t.Fatalf("%d images reserved, want 1", n)
+	}
+
+	if _, ok := idx.MatchOrReserve("other.jpg", 0x00FF00FF00FF00FF, 4); ok {
+		t.Fatal("different image matched")
+	}
+	idx.Release("other.jpg")
+	if _, ok := idx.Match(0x00FF00FF00FF00FF, 4); ok {
+		t.Error("released image still matches")
+	}
+
+	if err := idx.Add("saved.jpg", 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadHashIndex(idx.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if similar, ok := reloaded.Match(0x1234, 0); !ok || similar != "saved.jpg" {
+		t.Errorf("Match after reload = %q, %v", similar, ok)
+	}
+	if _, ok := reloaded.Lookup("0.jpg"); ok {
+		t.Error("reservation was written to the index file")
+	}
+}
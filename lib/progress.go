@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress accounts for tweets and media transfers as the Downloader works
+// through them. Frontends read it through Snapshot and receive log lines
+// through SetOutput. All methods are safe for concurrent use.
+type Progress struct {
+	mu      sync.Mutex
+	active  map[*Transfer]struct{}
+	output  func(string)
+	tweets  int
+	pending int
+	done    int
+	skipped int
+	failed  int
+	bytes   int64
+}
+
+// NewProgress returns a Progress printing lines to w until SetOutput.
+func NewProgress(w io.Writer) *Progress {
+	return &Progress{
+		active: make(map[*Transfer]struct{}),
+		output: func(line string) { fmt.Fprintln(w, line) },
+	}
+}
+
+// SetOutput redirects the lines the Downloader prints, so a live view can
+// draw them above itself.
+func (p *Progress) SetOutput(output func(string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.output = output
+}
+
+func (p *Progress) Println(line string) {
+	p.mu.Lock()
+	output := p.output
+	p.mu.Unlock()
+	output(line)
+}
+
+func (p *Progress) AddTweet() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tweets++
+}
+
+// Enqueue records n media files scheduled for download.
+func (p *Progress) Enqueue(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending += n
+}
+
+// Dequeue records that a scheduled media file has been handled, whether it
+// was transferred, skipped or failed.
+func (p *Progress) Dequeue() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending--
+}
+
+// Skip counts a media file that was not transferred at all.
+func (p *Progress) Skip() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.skipped++
+}
+
+// Start registers a transfer. Its size is unknown until SetSize is called.
+func (p *Progress) Start(name string) *Transfer {
+	t := &Transfer{
+		progress: p,
+		Name:     name,
+		Started:  time.Now(),
+	}
+	t.size.Store(-1)
+	p.mu.Lock()
+	p.active[t] = struct{}{}
+	p.mu.Unlock()
+	return t
+}
+
+type ProgressSnapshot struct {
+	Tweets    int
+	Queued    int
+	Done      int
+	Skipped   int
+	Failed    int
+	Bytes     int64
+	Transfers []TransferSnapshot
+}
+
+type TransferSnapshot struct {
+	Name  string
+	Bytes int64
+	Size  int64
+	Speed float64       // bytes per second
+	ETA   time.Duration // 0 if the size is unknown
+}
+
+func (p *Progress) Snapshot() ProgressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	s := ProgressSnapshot{
+		Tweets:  p.tweets,
+		Queued:  p.pending - len(p.active),
+		Done:    p.done,
+		Skipped: p.skipped,
+		Failed:  p.failed,
+		Bytes:   p.bytes,
+	}
+	for t := range p.active {
+		ts := TransferSnapshot{
+			Name:  t.Name,
+			Bytes: t.bytes.Load(),
+			Size:  t.size.Load(),
+		}
+		s.Bytes += ts.Bytes
+		if elapsed := now.Sub(t.Started).Seconds(); elapsed > 0 {
+			ts.Speed = float64(ts.Bytes) / elapsed
+		}
+		if ts.Size > 0 && ts.Speed > 0 {
+			ts.ETA = time.Duration(float64(ts.Size-ts.Bytes) / ts.Speed * float64(time.Second))
+		}
+		s.Transfers = append(s.Transfers, ts)
+	}
+	sort.Slice(s.Transfers, func(i, j int) bool { return s.Transfers[i].Name < s.Transfers[j].Name })
+	return s
+}
+
+// Transfer is one file being downloaded.
+type Transfer struct {
+	progress *Progress
+	Name     string
+	Started  time.Time
+	size     atomic.Int64
+	bytes    atomic.Int64
+}
+
+// SetSize records the expected size once the response headers are in, -1 if
+// the server didn't say.
+func (t *Transfer) SetSize(size int64) {
+	t.size.Store(size)
+}
+
+func (t *Transfer) Bytes() int64 {
+	return t.bytes.Load()
+}
+
+// Reader counts the bytes read from r towards the transfer.
+func (t *Transfer) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, t: t}
+}
+
+// Finish removes the transfer from the active set and counts it as done or
+// failed.
+func (t *Transfer) Finish(err error) {
+	p := t.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.active, t)
+	if err != nil {
+		p.failed++
+		return
+	}
+	p.done++
+	p.bytes += t.bytes.Load()
+}
+
+// Skip removes the transfer from the active set, counting it as skipped.
+func (t *Transfer) Skip() {
+	p := t.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.active, t)
+	p.skipped++
+}
+
+type progressReader struct {
+	r io.Reader
+	t *Transfer
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.t.bytes.Add(int64(n))
+	return n, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
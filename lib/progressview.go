@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+const maxShownTransfers = 8
+
+// ProgressView draws a Progress on a terminal: the active transfers with
+// bytes, speed and ETA, and a status line with the overall counters, redrawn
+// in place. When out is not a terminal it falls back to the plain lines the
+// Downloader prints.
+type ProgressView struct {
+	progress *Progress
+	out      *os.File
+	live     bool
+
+	mu    sync.Mutex
+	lines int
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewProgressView(progress *Progress, out *os.File, enabled bool) *ProgressView {
+	return &ProgressView{
+		progress: progress,
+		out:      out,
+		live:     enabled && term.IsTerminal(int(out.Fd())),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (v *ProgressView) Start() {
+	if !v.live {
+		close(v.done)
+		return
+	}
+
+	v.progress.SetOutput(v.println)
+	go func() {
+		defer close(v.done)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-v.stop:
+				v.mu.Lock()
+				v.clear()
+				v.mu.Unlock()
+				return
+			case <-ticker.C:
+				v.mu.Lock()
+				v.clear()
+				v.draw()
+				v.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Stop erases the live area and restores plain output.
+func (v *ProgressView) Stop() {
+	if v.live {
+		close(v.stop)
+		v.progress.SetOutput(func(line string) { fmt.Fprintln(v.out, line) })
+	}
+	<-v.done
+}
+
+// Write prints p line by line above the live area, so a log handler can
+// share the terminal with the view.
+func (v *ProgressView) Write(p []byte) (int, error) {
+	if !v.live {
+		return v.out.Write(p)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		v.println(line)
+	}
+	return len(p), nil
+}
+
+// Live reports whether the view draws on a terminal.
+func (v *ProgressView) Live() bool {
+	return v.live
+}
+
+func (v *ProgressView) println(line string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.clear()
+	fmt.Fprintln(v.out, line)
+	v.draw()
+}
+
+func (v *ProgressView) clear() {
+	for ; v.lines > 0; v.lines-- {
+		fmt.Fprint(v.out, "\033[1A\033[2K")
+	}
+}
+
+func (v *ProgressView) draw() {
+	width, _, err := term.GetSize(int(v.out.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+
+	s := v.progress.Snapshot()
+	var lines []string
+	for i, t := range s.Transfers {
+		if i == maxShownTransfers {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(s.Transfers)-i))
+			break
+		}
+		lines = append(lines, formatTransfer(t, width))
+	}
+	lines = append(lines, fmt.Sprintf("tweets %d | media %d done, %d skipped, %d failed | %d active, %d queued | %s",
+		s.Tweets, s.Done, s.Skipped, s.Failed, len(s.Transfers), s.Queued, formatBytes(s.Bytes)))
+
+	for _, line := range lines {
+		fmt.Fprintln(v.out, truncateWidth(line, width))
+	}
+	v.lines = len(lines)
+}
+
+func formatTransfer(t TransferSnapshot, width int) string {
+	stats := formatBytes(t.Bytes)
+	if t.Size > 0 {
+		stats += fmt.Sprintf(" / %s %3d%%", formatBytes(t.Size), t.Bytes*100/t.Size)
+	}
+	stats += fmt.Sprintf("  %s/s", formatBytes(int64(t.Speed)))
+	if t.ETA > 0 {
+		stats += "  ETA " + t.ETA.Round(time.Second).String()
+	}
+
+	nameWidth := max(width-len(stats)-4, 10)
+	name := t.Name
+	if displayWidth(name) > nameWidth {
+		name = truncateWidth(name, nameWidth-3) + "..."
+	}
+	pad := strings.Repeat(" ", max(nameWidth-displayWidth(name), 0))
+	return "  " + name + pad + "  " + strings.TrimSpace(stats)
+}
+
+// runeWidth is the number of terminal columns r takes: none for combining
+// and format characters, two for wide East Asian characters and emoji.
+func runeWidth(r rune) int {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf), r < 0x20:
+		return 0
+	case r >= 0x1100 && r <= 0x115F, // Hangul Jamo
+		r >= 0x2E80 && r <= 0xA4CF && r != 0x303F, // CJK ... Yi
+		r >= 0xAC00 && r <= 0xD7A3,                // Hangul syllables
+		r >= 0xF900 && r <= 0xFAFF,                // CJK compatibility ideographs
+		r >= 0xFE30 && r <= 0xFE4F,                // CJK compatibility forms
+		r >= 0xFF00 && r <= 0xFF60,                // fullwidth forms
+		r >= 0xFFE0 && r <= 0xFFE6,
+		r >= 0x1F300 && r <= 0x1FAFF, // emoji and pictographs
+		r >= 0x20000 && r <= 0x3FFFD:
+		return 2
+	}
+	return 1
+}
+
+func displayWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		n += runeWidth(r)
+	}
+	return n
+}
+
+// truncateWidth cuts s to at most width terminal columns, never within a
+// rune.
+func truncateWidth(s string, width int) string {
+	n := 0
+	for i, r := range s {
+		if n += runeWidth(r); n > width {
+			return s[:i]
+		}
+	}
+	return s
+}
@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProxyRoundRobin = "rr"
+	ProxyLRU        = "lru"
+
+	maxProxyCooldown = time.Hour
+
+	proxyProbeTimeout = 10 * time.Second
+)
+
+// proxyProbeURL is requested through a proxy coming back from its cooldown,
+// to check it works before anything else goes through it.
+var proxyProbeURL = "https://pbs.twimg.com/"
+
+type poolProxy struct {
+	addr      string
+	client    *http.Client
+	lastUsed  time.Time
+	coolUntil time.Time
+	failures  int
+}
+
+// ProxyPool spreads requests over several proxies. Proxies that fail or get
+// rate limited are put on a cooldown that doubles with each consecutive
+// failure, and are probed when it is over. It implements HTTPClient for media downloads; the scraper picks a
+// proxy from it and sticks to it until it fails.
+type ProxyPool struct {
+	mu       sync.Mutex
+	proxies  []*poolProxy
+	strategy string
+	cooldown time.Duration
+	next     int
+	logger   *slog.Logger
+}
+
+func NewProxyPool(addrs []string, strategy string, cooldown time.Duration, opts TransportOptions) (*ProxyPool, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("empty proxy list")
+	}
+	if strategy != ProxyRoundRobin && strategy != ProxyLRU {
+		return nil, fmt.Errorf("unknown proxy strategy %q", strategy)
+	}
+
+	pool := &ProxyPool{
+		strategy: strategy,
+		cooldown: cooldown,
+		logger:   (&Config{}).logger(),
+	}
+	for _, addr := range addrs {
+		parsedURL, err := ParseProxyURL(addr)
+		if err != nil {
+			return nil, err
+		}
+		pool.proxies = append(pool.proxies, &poolProxy{
+			addr:   addr,
+			client: newClient(parsedURL, opts),
+		})
+	}
+	return pool, nil
+}
+
+// LoadProxyFile reads one proxy URL per line, skipping blank lines and
+// # comments.
+func LoadProxyFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := ParseProxyURL(line); err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, scanner.Err()
+}
+
+func (p *ProxyPool) Len() int {
+	return len(p.proxies)
+}
+
+// pick returns the next healthy proxy according to the strategy, skipping
+// exclude. A proxy whose cooldown is over is probed first. ok is false if
+// every other proxy is cooling down.
+func (p *ProxyPool) pick(exclude *poolProxy) (proxy *poolProxy, ok bool) {
+	for {
+		proxy, probe, ok := p.choose(exclude)
+		if !ok {
+			return nil, false
+		}
+		// A failed probe puts the proxy on a longer cooldown, so this ends.
+		if !probe || p.probe(proxy) {
+			return proxy, true
+		}
+	}
+}
+
+// choose does the picking of pick. probe reports that the proxy's cooldown is
+// over; it is kept out of other picks until probed.
+func (p *ProxyPool) choose(exclude *poolProxy) (proxy *poolProxy, probe, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	healthy := func(pp *poolProxy) bool {
+		return pp != exclude && !now.Before(pp.coolUntil)
+	}
+
+	switch p.strategy {
+	case ProxyLRU:
+		for _, pp := range p.proxies {
+			if healthy(pp) && (proxy == nil || pp.lastUsed.Before(proxy.lastUsed)) {
+				proxy = pp
+			}
+		}
+	default:
+		for i := range p.proxies {
+			pp := p.proxies[(p.next+i)%len(p.proxies)]
+			if healthy(pp) {
+				proxy = pp
+				p.next = (p.next + i + 1) % len(p.proxies)
+				break
+			}
+		}
+	}
+
+	if proxy == nil {
+		return nil, false, false
+	}
+	proxy.lastUsed = now
+	if probe = !proxy.coolUntil.IsZero(); probe {
+		proxy.coolUntil = now.Add(proxyProbeTimeout)
+	}
+	return proxy, probe, true
+}
+
+// probe requests proxyProbeURL through proxy. A proxy that fails it goes back
+// on cooldown.
+func (p *ProxyPool) probe(proxy *poolProxy) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, proxyProbeURL, nil)
+	if err != nil {
+		return false
+	}
+
+	reason := ""
+	resp, err := proxy.client.Do(req)
+	if err != nil {
+		reason = err.Error()
+	} else {
+		resp.Body.Close()
+		if proxyFailed(resp.StatusCode) {
+			reason = resp.Status
+		}
+	}
+	if reason != "" {
+		p.fail(proxy, "probe failed: "+reason)
+		return false
+	}
+
+	p.mu.Lock()
+	proxy.coolUntil = time.Time{}
+	p.mu.Unlock()
+	p.logger.Info("proxy back from cooldown", "proxy", redactProxy(proxy.addr))
+	return true
+}
+
+// acquire is like pick but never fails: when every proxy is cooling down it
+// returns the one that recovers first.
+func (p *ProxyPool) acquire() *poolProxy {
+	if proxy, ok := p.pick(nil); ok {
+		return proxy
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	proxy := p.proxies[0]
+	for _, pp := range p.proxies[1:] {
+		if pp.coolUntil.Before(proxy.coolUntil) {
+			proxy = pp
+		}
+	}
+	proxy.lastUsed = time.Now()
+	return proxy
+}
+
+func (p *ProxyPool) fail(proxy *poolProxy, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proxy.failures++
+	cooldown := min(p.cooldown<<(min(proxy.failures, 10)-1), maxProxyCooldown)
+	proxy.coolUntil = time.Now().Add(cooldown)
+	p.logger.Warn("proxy cooling down", "proxy", redactProxy(proxy.addr), "cooldown", cooldown, "failures", proxy.failures, "reason", reason)
+}
+
+func (p *ProxyPool) succeed(proxy *poolProxy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	proxy.failures = 0
+}
+
+func (p *ProxyPool) Do(req *http.Request) (*http.Response, error) {
+	proxy := p.acquire()
+	resp, err := proxy.client.Do(req)
+	if err != nil {
+		p.fail(proxy, err.Error())
+		return nil, err
+	}
+
+	if proxyFailed(resp.StatusCode) {
+		p.fail(proxy, resp.Status)
+	} else {
+		p.succeed(proxy)
+	}
+	return resp, nil
+}
+
+// proxyFailed reports whether a response status is the proxy's fault, or
+// means it is rate limited.
+func proxyFailed(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		status == http.StatusProxyAuthRequired ||
+		status >= 500
+}
+
+// redactProxy hides credentials before a proxy address is printed.
+func redactProxy(addr string) string {
+	parsedURL, err := ParseProxyURL(addr)
+	if err != nil {
+		return addr
+	}
+	return parsedURL.Redacted()
+}
@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxChunk bounds a single read so one transfer can't grab a whole second of
+// budget at once and starve the others.
+const maxChunk = 32 * 1024
+
+// RateWindow caps bandwidth between two times of day. End may be before
+// Start, in which case the window wraps around midnight. A Rate of 0 means
+// unlimited.
+type RateWindow struct {
+	Start, End time.Duration
+	Rate       int64
+}
+
+func (w RateWindow) contains(t time.Duration) bool {
+	if w.Start <= w.End {
+		return t >= w.Start && t < w.End
+	}
+	return t >= w.Start || t < w.End
+}
+
+// BandwidthLimiter is a token bucket shared by every concurrent transfer, so
+// the cap applies to their combined throughput.
+type BandwidthLimiter struct {
+	mu       sync.Mutex
+	rate     int64
+	schedule []RateWindow
+	tokens   float64
+	last     time.Time
+}
+
+func NewBandwidthLimiter(rate int64, schedule []RateWindow) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		rate:     rate,
+		schedule: schedule,
+		last:     time.Now(),
+	}
+}
+
+func (l *BandwidthLimiter) rateAt(now time.Time) int64 {
+	y, m, d := now.Date()
+	sinceMidnight := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	for _, w := range l.schedule {
+		if w.contains(sinceMidnight) {
+			return w.Rate
+		}
+	}
+	return l.rate
+}
+
+// take debits n bytes from the bucket and sleeps until the debt is paid off
+// or ctx is done.
+func (l *BandwidthLimiter) take(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	rate := l.rateAt(now)
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		l.mu.Unlock()
+		return nil
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	if burst := float64(rate); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader wraps r so that reads from it count against the shared budget. The
+// waits end early when ctx is done.
+func (l *BandwidthLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+// pauser is a reader with an idle timeout, which must not run while the
+// limiter holds the transfer back.
+type pauser interface {
+	pause()
+	resume()
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *BandwidthLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if pr, ok := lr.r.(pauser); ok {
+			pr.pause()
+			defer pr.resume()
+		}
+		if werr := lr.limiter.take(lr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// ParseRate parses a byte rate such as 500K, 2M or 1.5G (per second, powers
+// of 1024). A plain number is bytes per second.
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(s, "/S")
+	s = strings.TrimSuffix(s, "B")
+	if s == "" {
+		return 0, fmt.Errorf("empty rate")
+	}
+
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// ParseRateSchedule parses a comma separated list of HH:MM-HH:MM=RATE
+// windows, e.g. "09:00-18:00=1M,18:00-09:00=0".
+func ParseRateSchedule(s string) ([]RateWindow, error) {
+	var schedule []RateWindow
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		span, rate, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q: missing =RATE", part)
+		}
+		from, to, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q: missing -", part)
+		}
+
+		var w RateWindow
+		var err error
+		if w.Start, err = parseClock(from); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseClock(to); err != nil {
+			return nil, err
+		}
+		if w.Rate, err = ParseRate(rate); err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, w)
+	}
+	return schedule, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: must be HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -3,6 +3,9 @@ package lib
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
 	"sync"
 
 	twitterscraper "github.com/imperatrona/twitter-scraper"
@@ -20,67 +23,282 @@ type ScrapeRunner struct {
 	httpClient HTTPClient
 	scraper    *twitterscraper.Scraper
 	downloader *Downloader
+	pacer      *Pacer
+	proxies    *ProxyPool
+	proxy      *poolProxy
+	loggedIn   bool
 }
 
-func NewScraper(config *Config, httpClient HTTPClient) *ScrapeRunner {
+func NewScraper(config *Config, httpClient HTTPClient) (*ScrapeRunner, error) {
 	scraper := twitterscraper.New()
 	scraper.WithReplies(true)
-	// scraper.SetProxy(proxy)
 
 	downloader := NewDownloader(config, httpClient)
-	return &ScrapeRunner{
+	runner := &ScrapeRunner{
 		cfg:        config,
 		httpClient: httpClient,
 		scraper:    scraper,
 		downloader: downloader,
+		pacer:      NewPacer(config.RequestDelay, config.logger()),
 	}
+
+	// With a proxy pool the scraper session sticks to one proxy, so a
+	// pagination cursor stays on the same exit, until that proxy fails.
+	if pool, ok := httpClient.(*ProxyPool); ok {
+		pool.logger = config.logger()
+		runner.proxies = pool
+		runner.pacer.rotate = runner.switchProxy
+		runner.pacer.maxRotations = pool.Len() - 1
+		if err := runner.useProxy(pool.acquire()); err != nil {
+			return nil, err
+		}
+	} else if config.Proxy != "" {
+		if err := scraper.SetProxy(config.Proxy); err != nil {
+			return nil, fmt.Errorf("error setting proxy: %w", err)
+		}
+	}
+
+	return runner, nil
 }
 
-func (s *ScrapeRunner) Run() error {
+func (s *ScrapeRunner) useProxy(proxy *poolProxy) error {
+	if err := s.scraper.SetProxy(proxy.addr); err != nil {
+		return fmt.Errorf("error setting proxy %s: %w", redactProxy(proxy.addr), err)
+	}
+	s.proxy = proxy
+	return nil
+}
 
-	if s.cfg.Login != "" || s.cfg.Loginp != "" {
-		auth := NewAuthenticator(s.scraper, s.cfg)
-		if err := auth.Login(); err != nil {
-			return err
+// switchProxy puts the scraper's proxy on cooldown and moves the session to
+// the next healthy one. It reports false when no other proxy is available.
+func (s *ScrapeRunner) switchProxy(err error) bool {
+	s.proxies.fail(s.proxy, err.Error())
+	next, ok := s.proxies.pick(s.proxy)
+	if !ok {
+		return false
+	}
+	if err := s.useProxy(next); err != nil {
+		s.log().Error("switching proxy failed", "error", err)
+		return false
+	}
+	s.log().Info("scraper switched proxy", "proxy", redactProxy(next.addr))
+	return true
+}
+
+// log returns the logger of the run, with the user being crawled.
+func (s *ScrapeRunner) log() *slog.Logger {
+	if s.cfg.User != "" {
+		return s.cfg.logger().With("user", s.cfg.User)
+	}
+	return s.cfg.logger()
+}
+
+// Run scrapes and downloads what the config asks for. Cancelling stop ends
+// the run gracefully: no new tweet is started, downloads in flight finish and
+// a user crawl saves its position for the next run. Cancelling abort also
+// interrupts the downloads in flight.
+func (s *ScrapeRunner) Run(stop, abort context.Context) error {
+	s.pacer.logger = s.log()
+	err := s.run(stop, abort)
+	if s.cfg.DryRun {
+		if !s.cfg.JSON {
+			s.downloader.printPlanTotals()
+		}
+	} else if !s.cfg.UrlOnly {
+		if jerr := s.downloader.updateJournal(); jerr != nil {
+			s.log().Error("updating failed-items journal failed", "file", failedJournalFile, "error", jerr)
+		}
+		if s.cfg.SetMtime {
+			s.downloader.applyDirTimes()
+		}
+		if s.cfg.ExecAfterRun != "" && abort.Err() == nil {
+			command, _ := SplitCommand(s.cfg.ExecAfterRun)
+			s.downloader.runCommand(abort, expandCommand(command, strings.NewReplacer("{dir}", s.cfg.OutputDir)))
 		}
 	}
+	return err
+}
+
+// AddHook registers h for the events of the run, see Downloader.AddHook.
+func (s *ScrapeRunner) AddHook(h func(Event)) {
+	s.downloader.AddHook(h)
+}
+
+// Summary totals the media results of the run so far.
+func (s *ScrapeRunner) Summary() Summary {
+	return s.downloader.summary()
+}
+
+// Progress exposes the download accounting, e.g. for a ProgressView.
+func (s *ScrapeRunner) Progress() *Progress {
+	return s.downloader.progress
+}
+
+// Login logs in when the config asks for it, prompting for the credentials
+// unless saved cookies still work. Run logs in if Login wasn't called before;
+// calling it first keeps the prompts clear of a progress view.
+func (s *ScrapeRunner) Login() error {
+	if s.loggedIn || (s.cfg.Login == "" && s.cfg.Loginp == "") {
+		return nil
+	}
+	auth := NewAuthenticator(s.scraper, s.cfg)
+	if err := auth.Login(); err != nil {
+		return &kindError{ErrAuthRequired, fmt.Errorf("login failed: %w", err)}
+	}
+	s.loggedIn = true
+	return nil
+}
+
+func (s *ScrapeRunner) run(stop, abort context.Context) error {
+	if err := s.Login(); err != nil {
+		return err
+	}
 
 	if s.cfg.TweetID != "" {
-		return s.RunSingleTweet(s.cfg.TweetID)
+		return s.RunSingleTweet(stop, abort, s.cfg.TweetID)
 	}
 
 	if s.cfg.User != "" {
-		return s.RunUserTweets()
+		return s.RunUserTweets(stop, abort)
 	}
 
 	return errors.New("no user or tweet id specified")
 }
 
-func (s *ScrapeRunner) RunSingleTweet(id string) error {
-	tweet, err := s.scraper.GetTweet(id)
+func (s *ScrapeRunner) RunSingleTweet(stop, abort context.Context, id string) error {
+	var tweet *twitterscraper.Tweet
+	err := s.pacer.Do(stop, "fetching tweet "+id, func() (err error) {
+		tweet, err = s.scraper.GetTweet(id)
+		return scraperError(err)
+	})
 	if err != nil {
 		return err
 	}
 	if tweet == nil {
-		return errors.New("error retrieving tweet")
+		return fmt.Errorf("tweet %s: %w", id, ErrNotFound)
 	}
 
-	return s.DownloadTweet(tweet)
+	s.downloader.tweetFound(tweet)
+	s.DownloadTweet(abort, tweet)
+	return nil
 }
 
-func (s *ScrapeRunner) RunUserTweets() error {
+// RunUserTweets downloads the media of the configured user's timeline. An
+// interrupted crawl leaves a state file in the output directory, and the next
+// run for the same user resumes from there.
+func (s *ScrapeRunner) RunUserTweets(stop, abort context.Context) error {
+	dir := s.cfg.OutputDir
+	state, err := loadCrawlState(dir, s.cfg.User)
+	if err != nil {
+		s.log().Warn("ignoring unreadable crawl state", "file", stateFile, "error", err)
+		state = nil
+	}
+	if s.cfg.DryRun || s.cfg.UrlOnly {
+		state = nil
+	}
+
+	var cursor string
+	scanned, skip := 0, 0
+	if state != nil {
+		cursor, scanned, skip = state.Cursor, state.Scanned, state.Skip
+		s.log().Info("resuming interrupted crawl", "scanned", scanned, "saved", state.Saved)
+	}
+	// Position of the next tweet to hand out: the page it belongs to and how
+	// many tweets of that page came before it.
+	pageCursor, pageOffset := cursor, skip
+
 	wg := sync.WaitGroup{}
-	for tweet := range s.scraper.GetTweets(context.Background(), s.cfg.User, s.cfg.NumberOfTweets) {
-		if tweet.Error != nil {
-			return tweet.Error
+	defer wg.Wait()
+	for tweet := range s.userTweets(stop, s.cfg.User, s.cfg.NumberOfTweets-scanned, cursor, skip) {
+		if tweet.err != nil {
+			if errors.Is(tweet.err, context.Canceled) && !s.cfg.DryRun && !s.cfg.UrlOnly {
+				next := crawlState{User: s.cfg.User, Cursor: pageCursor, Skip: pageOffset, Scanned: scanned}
+				if err := saveCrawlState(dir, next); err != nil {
+					s.log().Error("saving crawl state failed", "file", stateFile, "error", err)
+				} else {
+					s.log().Info("crawl position saved, run the same command again to resume", "scanned", scanned)
+				}
+			}
+			return tweet.err
+		}
+		if tweet.cursor != pageCursor {
+			pageCursor, pageOffset = tweet.cursor, 0
+		}
+		pageOffset++
+		scanned++
+
+		s.downloader.tweetFound(&tweet.Tweet)
+		wg.Add(1)
+		go func(t twitterscraper.Tweet) {
+			defer wg.Done()
+			s.DownloadTweet(abort, &t)
+		}(tweet.Tweet)
+	}
+
+	if state != nil {
+		if err := removeCrawlState(dir); err != nil {
+			s.log().Warn("removing crawl state failed", "file", stateFile, "error", err)
 		}
-		go s.DownloadTweet(&tweet.Tweet)
 	}
-	wg.Wait()
 	return nil
 }
 
-func (s *ScrapeRunner) DownloadTweet(tweet *twitterscraper.Tweet) error {
+// userTweet is a timeline tweet together with the cursor of its page.
+type userTweet struct {
+	twitterscraper.Tweet
+	cursor string
+	err    error
+}
+
+// userTweets pages through a user's timeline like scraper.GetTweets, but
+// sends every page request through the pacer. It starts at cursor, leaving out
+// the first skip tweets of that page. Once ctx is cancelled no further tweet
+// is sent, only ctx's error.
+func (s *ScrapeRunner) userTweets(ctx context.Context, user string, maxTweets int, cursor string, skip int) <-chan userTweet {
+	channel := make(chan userTweet)
+	go func() {
+		defer close(channel)
+		count := 0
+		for count < maxTweets {
+			var tweets []*twitterscraper.Tweet
+			var next string
+			s.log().Debug("fetching timeline page", "cursor", cursor, "tweets", count)
+			err := s.pacer.Do(ctx, "fetching tweets of "+user, func() (err error) {
+				tweets, next, err = s.scraper.FetchTweets(user, maxTweets, cursor)
+				return scraperError(err)
+			})
+			if err != nil {
+				channel <- userTweet{err: err}
+				return
+			}
+			if len(tweets) == 0 || next == cursor {
+				return
+			}
+
+			for i, tweet := range tweets {
+				if i < skip {
+					continue
+				}
+				if count >= maxTweets {
+					return
+				}
+				if ctx.Err() != nil {
+					channel <- userTweet{err: ctx.Err()}
+					return
+				}
+				channel <- userTweet{Tweet: *tweet, cursor: cursor}
+				count++
+			}
+			cursor, skip = next, 0
+		}
+	}()
+	return channel
+}
+
+// DownloadTweet saves the media of one tweet and returns one result per media
+// file, in the order of the tweet's videos then photos. Retweets filtered out
+// by the config yield no results. Cancelling ctx aborts the transfers.
+func (s *ScrapeRunner) DownloadTweet(ctx context.Context, tweet *twitterscraper.Tweet) []MediaResult {
 	if tweet.IsRetweet && (!s.cfg.Retweets) {
 		return nil
 	}
@@ -88,17 +306,15 @@ func (s *ScrapeRunner) DownloadTweet(tweet *twitterscraper.Tweet) error {
 		return nil
 	}
 
+	var results []MediaResult
 	if s.cfg.Videos {
-		err := s.downloader.downloadVideos(tweet)
-		if err != nil {
-			return err
-		}
+		results = append(results, s.downloader.downloadVideos(ctx, tweet)...)
 	}
 	if s.cfg.Images {
-		err := s.downloader.downloadPhotos(tweet)
-		if err != nil {
-			return err
-		}
+		results = append(results, s.downloader.downloadPhotos(ctx, tweet)...)
 	}
-	return nil
+	if s.cfg.WriteInfoJSON != "" {
+		s.downloader.writeInfoJSON(tweet, results)
+	}
+	return results
 }
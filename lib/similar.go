@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var imageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// RunSimilar implements `twmd similar DIR`: it hashes every image anywhere
+// in a downloaded user folder and prints the groups of near-duplicates.
+func RunSimilar(args []string) error {
+	flags := flag.NewFlagSet("similar", flag.ExitOnError)
+	threshold := flags.Int("threshold", 10, "Maximum Hamming distance between two near-duplicate images (0-64)")
+	cfg := &Config{}
+	addLogFlags(flags, cfg)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: twmd similar [options] DIR\n\nGroup near-duplicate images in a downloaded user folder.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		quitWithError(flags, "You must specify the user folder to scan")
+	}
+	if *threshold < 0 || *threshold > 64 {
+		quitWithError(flags, "Threshold must be between 0 and 64")
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		quitWithError(flags, "Error in log-format: Must be one of text, json")
+	}
+
+	logger, logFile, err := OpenLogger(cfg, os.Stderr)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	dir := flags.Arg(0)
+	idx, err := LoadHashIndex(filepath.Join(dir, hashIndexFile))
+	if err != nil {
+		return fmt.Errorf("error reading hash index: %w", err)
+	}
+
+	// Only files still on disk take part; the index may remember deleted
+	// ones. The index is keyed by file name, as the downloader writes it.
+	images := make(map[string]uint64)
+	err = filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := e.Name()
+		if e.IsDir() {
+			if path != dir && (strings.HasPrefix(name, ".") || name == galleryDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, ".") || !imageExts[strings.ToLower(filepath.Ext(name))] {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if hash, ok := idx.Lookup(name); ok {
+			images[rel] = hash
+			return nil
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			logger.Warn("hashing failed", "file", rel, "error", err)
+			return nil
+		}
+		if err := idx.Add(name, hash); err != nil {
+			return fmt.Errorf("error writing hash index: %w", err)
+		}
+		images[rel] = hash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	groups := GroupSimilar(images, *threshold)
+	for _, group := range groups {
+		sort.Strings(group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+
+	for i, group := range groups {
+		fmt.Printf("group %d (%d files):\n", i+1, len(group))
+		for _, rel := range group {
+			fmt.Println("  " + filepath.Join(dir, rel))
+		}
+	}
+	fmt.Printf("%d groups of near-duplicates\n", len(groups))
+	return nil
+}
+
+func hashFile(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return HashImage(f)
+}
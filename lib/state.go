@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const stateFile = "twmd_state.json"
+
+// crawlState is saved when a user crawl is interrupted so the next run can
+// pick up the timeline where this one stopped.
+// Cursor is the page holding the next tweet to handle, Skip how many tweets
+// of that page were handled already and Scanned the total so far.
+type crawlState struct {
+	User    string    `json:"user"`
+	Cursor  string    `json:"cursor"`
+	Skip    int       `json:"skip"`
+	Scanned int       `json:"scanned"`
+	Saved   time.Time `json:"saved"`
+}
+
+func loadCrawlState(dir, user string) (*crawlState, error) {
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state crawlState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.User != user {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func saveCrawlState(dir string, state crawlState) error {
+	state.Saved = time.Now()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	return writeFileAtomic(context.Background(), filepath.Join(dir, stateFile), bytes.NewReader(data), 0644)
+}
+
+func removeCrawlState(dir string) error {
+	err := os.Remove(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Exit codes of the twmd command, so wrappers can tell a clean run from a
+// partial one.
+const (
+	ExitOK          = 0
+	ExitError       = 1
+	ExitPartial     = 2
+	ExitAuth        = 3
+	ExitRateLimited = 4
+)
+
+// MediaStatus says what happened to one media file.
+type MediaStatus int
+
+const (
+	// MediaPlanned is reported in -dry-run and -url modes, which transfer
+	// nothing.
+	MediaPlanned MediaStatus = iota
+	MediaDownloaded
+	MediaSkipped
+	MediaFailed
+)
+
+func (s MediaStatus) String() string {
+	switch s {
+	case MediaDownloaded:
+		return "downloaded"
+	case MediaSkipped:
+		return "skipped"
+	case MediaFailed:
+		return "failed"
+	default:
+		return "planned"
+	}
+}
+
+// MediaResult is the outcome of one media file. Err is the failure for
+// MediaFailed and the reason, matching ErrAlreadyExists, for MediaSkipped.
+// Index is the position of the media in the tweet, counting from 1 over the
+// videos then the photos. Width and Height are known for videos and for
+// downloaded images. Hash is the perceptual hash of a downloaded image, see
+// DHash; it is 0 for other media and for images that could not be decoded.
+type MediaResult struct {
+	TweetID  string
+	Username string
+	Index    int
+	URL      string
+	Name     string
+	Type     string
+	Path     string
+	Status   MediaStatus
+	Bytes    int64
+	Width    int
+	Height   int
+	Hash     uint64
+	Err      error
+}
+
+// record keeps result for the summary and reports it to the hooks. ctx is
+// the context of its transfer.
+func (d *Downloader) record(ctx context.Context, result MediaResult) {
+	if result.Status == MediaFailed {
+		d.log().Warn("media failed", "tweet_id", result.TweetID, "url", result.URL, "path", result.Path,
+			"error_class", errorClass(result.Err), "error", result.Err)
+	}
+
+	d.resultsMu.Lock()
+	d.results = append(d.results, result)
+	d.resultsMu.Unlock()
+
+	d.emit(Event{Type: mediaEvents[result.Status], Media: &result, ctx: ctx})
+}
+
+// mediaResults returns a copy of the results recorded so far.
+func (d *Downloader) mediaResults() []MediaResult {
+	d.resultsMu.Lock()
+	defer d.resultsMu.Unlock()
+	return append([]MediaResult(nil), d.results...)
+}
+
+type Summary struct {
+	Tweets      int   `json:"tweets"`
+	Planned     int   `json:"planned"`
+	Downloaded  int   `json:"downloaded"`
+	Skipped     int   `json:"skipped"`
+	Failed      int   `json:"failed"`
+	Bytes       int64 `json:"bytes"`
+	RateLimited bool  `json:"rate_limited"`
+}
+
+func (d *Downloader) summary() Summary {
+	s := Summary{Tweets: d.progress.Snapshot().Tweets}
+
+	d.resultsMu.Lock()
+	defer d.resultsMu.Unlock()
+	for _, r := range d.results {
+		switch r.Status {
+		case MediaPlanned:
+			s.Planned++
+		case MediaDownloaded:
+			s.Downloaded++
+			s.Bytes += r.Bytes
+		case MediaSkipped:
+			s.Skipped++
+		case MediaFailed:
+			s.Failed++
+			if errors.Is(r.Err, ErrRateLimited) {
+				s.RateLimited = true
+			}
+		}
+	}
+	return s
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d tweets scanned, %d media downloaded, %d skipped, %d failed, %s",
+		s.Tweets, s.Downloaded, s.Skipped, s.Failed, formatBytes(s.Bytes))
+}
+
+// ExitCode maps the outcome of a run to the process exit code.
+func ExitCode(err error, s Summary) int {
+	switch {
+	case errors.Is(err, ErrAuthRequired):
+		return ExitAuth
+	case errors.Is(err, context.Canceled):
+		return ExitPartial
+	case errors.Is(err, ErrRateLimited) || s.RateLimited:
+		return ExitRateLimited
+	case err == nil && s.Failed == 0:
+		return ExitOK
+	case s.Downloaded > 0:
+		// Some media were saved; with nothing saved, failures are an error.
+		return ExitPartial
+	default:
+		return ExitError
+	}
+}
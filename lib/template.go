@@ -0,0 +1,368 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Template is a parsed -file-format or -output-template. It is literal text
+// with tokens:
+//
+//	{NAME}               the value of a token, see templateTokens
+//	{NAME:mod:mod}       with modifiers: a length to cut the value to (60),
+//	                     a width to zero-pad it to (03), lower or upper
+//	{DATE:layout}        the date in a Go time layout, colons included
+//	                     (2006-01-02 15:04)
+//	{NAME|OTHER|"text"}  the first of the alternatives that isn't empty
+//	[text {NAME} text]   an optional part, left out if a token in it is empty
+//
+// {{, }}, [[ and ]] stand for literal braces and brackets.
+type Template struct {
+	src    string
+	nodes  []templateNode
+	tokens map[string]bool
+}
+
+type templateNode struct {
+	literal string
+	// alts are the alternatives of a token; none for a literal.
+	alts []templateAlt
+	// section holds the nodes of an optional part.
+	section []templateNode
+	src     string
+}
+
+type templateAlt struct {
+	name    string
+	literal string
+	mods    []string
+	// layout is the time layout of a date token, if given.
+	layout string
+}
+
+// TemplateError reports a bad token of a template.
+type TemplateError struct {
+	Token string
+	Msg   string
+}
+
+func (e *TemplateError) Error() string {
+	if e.Token == "" {
+		return e.Msg
+	}
+	return e.Token + ": " + e.Msg
+}
+
+// templateToken is the value of a token for one media file. Tokens with a
+// date format the time it returns.
+type templateToken struct {
+	value func(m *mediaFile) string
+	date  func(m *mediaFile) time.Time
+}
+
+var templateTokens = map[string]templateToken{
+	"USER":     {value: func(m *mediaFile) string { return m.user }},
+	"USERNAME": {value: func(m *mediaFile) string { return m.subject().Username }},
+	"NAME":     {value: func(m *mediaFile) string { return m.subject().Name }},
+	"ID":       {value: func(m *mediaFile) string { return m.subject().ID }},
+	"USER_ID":  {value: func(m *mediaFile) string { return m.subject().UserID }},
+	"DATE":     {date: func(m *mediaFile) time.Time { return time.Unix(m.subject().Timestamp, 0) }},
+	"YEAR":     {value: func(m *mediaFile) string { return m.date().Format("2006") }},
+	"MONTH":    {value: func(m *mediaFile) string { return m.date().Format("01") }},
+	"DAY":      {value: func(m *mediaFile) string { return m.date().Format("02") }},
+	"TITLE":    {value: func(m *mediaFile) string { return formatTitle(m.subject()) }},
+	"TYPE":     {value: func(m *mediaFile) string { return m.fileType }},
+	"INDEX":    {value: func(m *mediaFile) string { return countString(m.index) }},
+	"COUNT":    {value: func(m *mediaFile) string { return countString(m.count) }},
+	"MEDIA_ID": {value: func(m *mediaFile) string { return m.id }},
+	"FILE":     {value: func(m *mediaFile) string { return strings.TrimSuffix(m.cdnName(), m.ext()) }},
+	"EXT":      {value: func(m *mediaFile) string { return strings.TrimPrefix(m.ext(), ".") }},
+	"FILENAME": {value: func(m *mediaFile) string { return m.filename }},
+	"LIKES":    {value: func(m *mediaFile) string { return strconv.Itoa(m.subject().Likes) }},
+	"RETWEETS": {value: func(m *mediaFile) string { return strconv.Itoa(m.subject().Retweets) }},
+	"REPLIES":  {value: func(m *mediaFile) string { return strconv.Itoa(m.subject().Replies) }},
+	"VIEWS":    {value: func(m *mediaFile) string { return strconv.Itoa(m.subject().Views) }},
+	"HASHTAGS": {value: func(m *mediaFile) string { return strings.Join(m.subject().Hashtags, "_") }},
+	"QUOTED_USER": {value: func(m *mediaFile) string {
+		if q := m.subject().QuotedStatus; q != nil {
+			return q.Username
+		}
+		return ""
+	}},
+	"RT_AUTHOR": {value: func(m *mediaFile) string {
+		if rt := m.tweet.RetweetedStatus; rt != nil {
+			return rt.Username
+		}
+		return ""
+	}},
+}
+
+// countString leaves out the zero of a file that isn't a tweet's media.
+func countString(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// parseTemplate parses src, accepting all tokens except those in exclude.
+func parseTemplate(src string, exclude ...string) (*Template, error) {
+	t := &Template{src: src, tokens: make(map[string]bool)}
+	p := &templateParser{src: src, t: t, exclude: exclude}
+	nodes, err := p.parse(false)
+	if err != nil {
+		return nil, err
+	}
+	t.nodes = nodes
+	return t, nil
+}
+
+type templateParser struct {
+	src     string
+	pos     int
+	t       *Template
+	exclude []string
+}
+
+// parse reads nodes up to the end of src, or in a section up to its ].
+func (p *templateParser) parse(inSection bool) ([]templateNode, error) {
+	var nodes []templateNode
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			nodes = append(nodes, templateNode{literal: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case (c == '{' || c == '}' || c == '[' || c == ']') && p.pos+1 < len(p.src) && p.src[p.pos+1] == c:
+			lit.WriteByte(c)
+			p.pos += 2
+		case c == '{':
+			flush()
+			node, err := p.token()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, node)
+		case c == '[':
+			if inSection {
+				return nil, &TemplateError{Msg: fmt.Sprintf("nested [ at position %d", p.pos+1)}
+			}
+			flush()
+			start := p.pos
+			p.pos++
+			section, err := p.parse(true)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, templateNode{section: section, src: p.src[start:p.pos]})
+		case c == ']':
+			if !inSection {
+				return nil, &TemplateError{Msg: fmt.Sprintf("unmatched ] at position %d", p.pos+1)}
+			}
+			p.pos++
+			flush()
+			return nodes, nil
+		case c == '}':
+			return nil, &TemplateError{Msg: fmt.Sprintf("unmatched } at position %d", p.pos+1)}
+		default:
+			lit.WriteByte(c)
+			p.pos++
+		}
+	}
+	if inSection {
+		return nil, &TemplateError{Msg: "unclosed ["}
+	}
+	flush()
+	return nodes, nil
+}
+
+// token reads a {...} token starting at p.pos.
+func (p *templateParser) token() (templateNode, error) {
+	start := p.pos
+	end := -1
+	quoted := false
+	for i := start + 1; i < len(p.src); i++ {
+		if p.src[i] == '"' {
+			quoted = !quoted
+		} else if p.src[i] == '}' && !quoted {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return templateNode{}, &TemplateError{Token: p.src[start:], Msg: "unclosed {"}
+	}
+	src := p.src[start : end+1]
+	p.pos = end + 1
+
+	node := templateNode{src: src}
+	for _, alt := range splitOutsideQuotes(src[1:len(src)-1], '|') {
+		a, err := p.alt(src, alt)
+		if err != nil {
+			return templateNode{}, err
+		}
+		node.alts = append(node.alts, a)
+	}
+	return node, nil
+}
+
+func (p *templateParser) alt(src, s string) (templateAlt, error) {
+	if strings.HasPrefix(s, `"`) {
+		if len(s) < 2 || !strings.HasSuffix(s, `"`) || strings.Count(s, `"`) != 2 {
+			return templateAlt{}, &TemplateError{Token: src, Msg: fmt.Sprintf("bad text %s", s)}
+		}
+		return templateAlt{literal: s[1 : len(s)-1]}, nil
+	}
+
+	parts := strings.Split(s, ":")
+	a := templateAlt{name: parts[0], mods: parts[1:]}
+	if a.name == "" {
+		return templateAlt{}, &TemplateError{Token: src, Msg: "empty token"}
+	}
+	tok, ok := templateTokens[a.name]
+	if !ok {
+		return templateAlt{}, &TemplateError{Token: src, Msg: fmt.Sprintf("unknown token %s", a.name)}
+	}
+	for _, ex := range p.exclude {
+		if a.name == ex {
+			return templateAlt{}, &TemplateError{Token: src, Msg: fmt.Sprintf("%s can't be used here", a.name)}
+		}
+	}
+	if tok.date != nil && len(a.mods) > 0 {
+		a.layout, a.mods = strings.Join(a.mods, ":"), nil
+		if layoutReference.Format(a.layout) == a.layout {
+			return templateAlt{}, &TemplateError{Token: src, Msg: fmt.Sprintf("layout %q has no date or time elements, see https://go.dev/src/time/format.go", a.layout)}
+		}
+	}
+	for _, mod := range a.mods {
+		switch {
+		case mod == "lower" || mod == "upper":
+		case mod != "" && strings.Trim(mod, "0123456789") == "" && len(mod) < 4:
+		default:
+			return templateAlt{}, &TemplateError{Token: src, Msg: fmt.Sprintf("unknown modifier %q", mod)}
+		}
+	}
+	p.t.tokens[a.name] = true
+	return a, nil
+}
+
+// layoutReference is a time whose every element differs from the reference
+// time of layouts, to tell layouts from plain text.
+var layoutReference = time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+// splitOutsideQuotes splits s at every sep that isn't between double quotes.
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Uses reports whether the template has the token name anywhere.
+func (t *Template) Uses(name string) bool {
+	return t.tokens[name]
+}
+
+func (t *Template) String() string {
+	return t.src
+}
+
+// execute expands the template for m. clean is applied to every token value
+// after its modifiers, e.g. to keep path separators out.
+func (t *Template) execute(m *mediaFile, clean func(name, value string) string) string {
+	var b strings.Builder
+	executeNodes(&b, t.nodes, m, clean)
+	return b.String()
+}
+
+// executeNodes writes nodes to b and reports whether all their tokens had a
+// value.
+func executeNodes(b *strings.Builder, nodes []templateNode, m *mediaFile, clean func(name, value string) string) bool {
+	complete := true
+	for _, n := range nodes {
+		switch {
+		case n.section != nil:
+			var section strings.Builder
+			if executeNodes(&section, n.section, m, clean) {
+				b.WriteString(section.String())
+			}
+		case n.alts != nil:
+			value := ""
+			for _, a := range n.alts {
+				if value = a.value(m, clean); value != "" {
+					break
+				}
+			}
+			if value == "" {
+				complete = false
+			}
+			b.WriteString(value)
+		default:
+			b.WriteString(n.literal)
+		}
+	}
+	return complete
+}
+
+func (a templateAlt) value(m *mediaFile, clean func(name, value string) string) string {
+	if a.name == "" {
+		return a.literal
+	}
+	tok := templateTokens[a.name]
+	mods := a.mods
+
+	var value string
+	if tok.date != nil {
+		layout := a.layout
+		if layout == "" {
+			layout = m.datefmt
+		}
+		if layout == "" {
+			layout = "2006-01-02"
+		}
+		value = tok.date(m).Format(layout)
+	} else {
+		value = tok.value(m)
+	}
+	for _, mod := range mods {
+		switch {
+		case mod == "lower":
+			value = strings.ToLower(value)
+		case mod == "upper":
+			value = strings.ToUpper(value)
+		case strings.HasPrefix(mod, "0") && len(mod) > 1:
+			width, _ := strconv.Atoi(mod)
+			if pad := width - utf8.RuneCountInString(value); pad > 0 {
+				value = strings.Repeat("0", pad) + value
+			}
+		default:
+			n, _ := strconv.Atoi(mod)
+			if r := []rune(value); len(r) > n {
+				value = strings.TrimSpace(string(r[:n]))
+			}
+		}
+	}
+	if value == "" {
+		return ""
+	}
+	return clean(a.name, value)
+}
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	twitterscraper "github.com/imperatrona/twitter-scraper"
+)
+
+func testMediaFile() *mediaFile {
+	original := &twitterscraper.Tweet{
+		ID:        "111",
+		UserID:    "42",
+		Username:  "Original",
+		Name:      "Orig/Name",
+		Text:      "Hello: world",
+		Hashtags:  []string{"trains", "graffiti"},
+		Likes:     5,
+		Timestamp: 1700000000, // 2023-11-14 22:13:20 UTC
+	}
+	tweet := &twitterscraper.Tweet{
+		ID:              "222",
+		Username:        "Retweeter",
+		Name:            "RT",
+		Timestamp:       1600000000, // 2020-09-13 12:26:40 UTC
+		RetweetedStatus: original,
+	}
+	return &mediaFile{
+		tweetMediaFile: tweetMediaFile{
+			index: 2, count: 3, id: "999", fileType: "img",
+			url: "https://pbs.twimg.com/media/ABC.jpg?name=large",
+		},
+		tweet: tweet,
+		user:  "user",
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		src     string
+		wantErr string
+	}{
+		{src: "{ID}"},
+		{src: "plain text"},
+		{src: "{{{ID}}} [[x]]"},
+		{src: `{QUOTED_USER|RT_AUTHOR|"none"}`},
+		{src: "[_{TITLE:60:lower}]"},
+		{src: "{INDEX:03}"},
+		{src: "{DATE:2006}"},
+		{src: "{DATE:15:04:05}"},
+		{src: "{FOO}", wantErr: "{FOO}: unknown token FOO"},
+		{src: "{}", wantErr: "{}: empty token"},
+		{src: "{USERNAME:lowr}", wantErr: `{USERNAME:lowr}: unknown modifier "lowr"`},
+		{src: "{ID:}", wantErr: `{ID:}: unknown modifier ""`},
+		{src: "{DATE:lower}", wantErr: `{DATE:lower}: layout "lower" has no date or time elements`},
+		{src: `{ID|"x"y}`, wantErr: `{ID|"x"y}: bad text "x"y`},
+		{src: "{ID", wantErr: "{ID: unclosed {"},
+		{src: "ID}", wantErr: "unmatched } at position 3"},
+		{src: "[{ID}", wantErr: "unclosed ["},
+		{src: "{ID}]", wantErr: "unmatched ] at position 5"},
+		{src: "[[{ID}]]]", wantErr: "unmatched ] at position 9"},
+		{src: "[a[{ID}]]", wantErr: "nested [ at position 3"},
+	}
+	for _, tt := range tests {
+		_, err := parseTemplate(tt.src)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("parseTemplate(%q) = %v, want no error", tt.src, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("parseTemplate(%q) = %v, want error %q", tt.src, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTemplateExecute(t *testing.T) {
+	// Dates are formatted in local time.
+	local := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = local })
+
+	tests := []struct {
+		src     string
+		datefmt string
+		want    string
+	}{
+		{src: "{USERNAME}_{NAME}_{ID}_{USER_ID}", want: "Retweeter_RT_222_"},
+		{src: "{RT_AUTHOR}_{QUOTED_USER}", want: "Original_"},
+		{src: "{INDEX}of{COUNT}_{MEDIA_ID}_{TYPE}", want: "2of3_999_img"},
+		{src: "{FILE}.{EXT}", want: "ABC.jpg"},
+		{src: "{INDEX:03}", want: "002"},
+		{src: "{RT_AUTHOR:4:upper}", want: "ORIG"},
+		{src: "{RT_AUTHOR:lower}", want: "original"},
+		{src: "{DATE}", want: "2020-09-13"},
+		{src: "{DATE}", datefmt: "02.01.2006", want: "13.09.2020"},
+		{src: "{DATE:2006}", datefmt: "02.01.2006", want: "2020"},
+		{src: "{DATE:01}", want: "09"},
+		{src: "{DATE:2006-01-02 15:04}", want: "2020-09-13 12:26"},
+		{src: "{YEAR}/{MONTH}/{DAY}", want: "2020/09/13"},
+		{src: "{{{ID}}} [[x]]", want: "{222} [x]"},
+		{src: `{QUOTED_USER|"none"}`, want: "none"},
+		{src: `{QUOTED_USER|RT_AUTHOR|"none"}`, want: "Original"},
+		{src: "a[_{QUOTED_USER}_]b", want: "ab"},
+		{src: "a[_{RT_AUTHOR}_]b", want: "a_Original_b"},
+		{src: `a[_{QUOTED_USER|"x"}]b`, want: "a_xb"},
+		{src: "{LIKES}_{HASHTAGS}", want: "0_"},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseTemplate(tt.src)
+		if err != nil {
+			t.Errorf("parseTemplate(%q) = %v", tt.src, err)
+			continue
+		}
+		m := testMediaFile()
+		m.datefmt = tt.datefmt
+		if got := tmpl.execute(m, func(_, value string) string { return value }); got != tt.want {
+			t.Errorf("execute(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateExecuteByAuthor(t *testing.T) {
+	tmpl, err := parseTemplate("{USERNAME}/{HASHTAGS}/{LIKES}/{ID}_{INDEX}.{EXT}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testMediaFile()
+	m.byAuthor = true
+	got := tmpl.execute(m, func(_, value string) string { return value })
+	if want := "Original/trains_graffiti/5/111_2.jpg"; got != want {
+		t.Errorf("execute = %q, want %q", got, want)
+	}
+}
+
+func TestParseFileFormat(t *testing.T) {
+	tests := []struct {
+		format  string
+		want    string
+		wantErr string
+	}{
+		{format: "{USERNAME} {NAME} {ID}", want: "Retweeter_RT_222"},
+		{format: "{ID}  {TITLE}", want: "222_"},
+		{format: "{ID} - {NAME}", want: "222 - RT"},
+		{format: "{RT_AUTHOR|USERNAME}_{INDEX:02}", want: "Original_02"},
+		{format: "{ID}_{INDEX}.{EXT}", want: "222_2.jpg"},
+		{format: "{RT_AUTHOR:lower}", want: "original"},
+		{format: "plain", wantErr: "must include at least one token"},
+		{format: "{ID}/{INDEX}", wantErr: "must not contain / or \\"},
+		{format: "{FILENAME}", wantErr: "{FILENAME}: FILENAME can't be used here"},
+		{format: "{ID}.{EXT}", wantErr: "with {EXT}, must include"},
+		{format: "{DATE:15:04} {ID:x}", wantErr: `{ID:x}: unknown modifier "x"`},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParseFileFormat(tt.format)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseFileFormat(%q) = %v, want error %q", tt.format, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseFileFormat(%q) = %v", tt.format, err)
+			continue
+		}
+		if got := formatFileName(tmpl, testMediaFile()); got != tt.want {
+			t.Errorf("formatFileName(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestFileFormatSeparators(t *testing.T) {
+	m := testMediaFile()
+	m.tweet.Name = "a/b\\c"
+	tmpl, err := ParseFileFormat("{NAME}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := formatFileName(tmpl, m), "a_b_c"; got != want {
+		t.Errorf("formatFileName = %q, want %q", got, want)
+	}
+}
@@ -1,17 +1,134 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 	"twmd/lib"
 )
 
+// interruptible returns two contexts: stop is cancelled by the first SIGINT or
+// SIGTERM, abort by the second one.
+func interruptible() (stop, abort context.Context) {
+	stop, cancelStop := context.WithCancel(context.Background())
+	abort, cancelAbort := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "\nInterrupted: finishing downloads in progress, press Ctrl-C again to abort them")
+		cancelStop()
+		<-signals
+		fmt.Fprintln(os.Stderr, "\nAborting")
+		cancelAbort()
+		signal.Stop(signals)
+	}()
+	return stop, abort
+}
+
 func main() {
+	logger := lib.NewLogger(os.Stderr, slog.LevelInfo, false)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "similar":
+			if err := lib.RunSimilar(os.Args[2:]); err != nil {
+				fatal(logger, err)
+			}
+			return
+		case "gallery":
+			if err := lib.RunGallery(os.Args[2:]); err != nil {
+				fatal(logger, err)
+			}
+			return
+		case "export":
+			stop, _ := interruptible()
+			if err := lib.RunExport(stop, os.Args[2:]); err != nil {
+				fatal(logger, err)
+			}
+			return
+		case "retry-failed":
+			stop, abort := interruptible()
+			summary, err := lib.RunRetryFailed(stop, abort, os.Args[2:])
+			// Nothing was retried when the summary is empty.
+			if summary != (lib.Summary{}) {
+				fmt.Println("Summary:", summary)
+			}
+			if err != nil {
+				logger.Error("retry failed", "error", err)
+			}
+			os.Exit(lib.ExitCode(err, summary))
+		}
+	}
+
 	cfg := lib.Configure()
 
-	httpClient := lib.NewHTTPClient(cfg.Proxy)
-	twitterScraper := lib.NewScraper(cfg, httpClient)
+	logSink := lib.NewLogSink(os.Stderr)
+	runLogger, logFile, err := lib.OpenLogger(cfg, logSink)
+	if err != nil {
+		fatal(logger, err)
+	}
+	logger = runLogger
+	cfg.Logger = logger
+
+	// With -json only events go to stdout; everything else is printed on
+	// stderr.
+	var events *lib.JSONWriter
+	out := os.Stdout
+	if cfg.JSON {
+		events = lib.NewJSONWriter(os.Stdout)
+		out = os.Stderr
+	}
+	cfg.Stdout = out
 
-	if err := twitterScraper.Run(); err != nil {
-		log.Fatalf("Error: %v", err)
+	var httpClient lib.HTTPClient
+	if len(cfg.ProxyList) > 0 {
+		httpClient, err = lib.NewProxyPool(cfg.ProxyList, cfg.ProxyStrategy, cfg.ProxyCooldown, cfg.Transport)
+	} else {
+		httpClient, err = lib.NewHTTPClient(cfg.Proxy, cfg.Transport)
+	}
+	if err != nil {
+		fatal(logger, err)
+	}
+	twitterScraper, err := lib.NewScraper(cfg, httpClient)
+	if err != nil {
+		fatal(logger, err)
 	}
+
+	if events != nil {
+		twitterScraper.AddHook(events.Hook)
+	}
+
+	view := lib.NewProgressView(twitterScraper.Progress(), out, !cfg.NoProgress && !cfg.UrlOnly && !cfg.DryRun && !cfg.JSON)
+	stop, abort := interruptible()
+	// The login prompts come first, before the view takes over the terminal.
+	if err = twitterScraper.Login(); err == nil {
+		if view.Live() {
+			logSink.SetOutput(view)
+		}
+		view.Start()
+		err = twitterScraper.Run(stop, abort)
+		view.Stop()
+		logSink.SetOutput(os.Stderr)
+	}
+
+	summary := twitterScraper.Summary()
+	if events != nil {
+		events.WriteSummary(summary, lib.ExitCode(err, summary))
+	} else if !cfg.UrlOnly && !cfg.DryRun {
+		fmt.Println("Summary:", summary)
+	}
+	if err != nil {
+		logger.Error("run failed", "user", cfg.User, "error", err)
+	}
+	logFile.Close()
+	os.Exit(lib.ExitCode(err, summary))
+}
+
+func fatal(logger *slog.Logger, err error) {
+	logger.Error(err.Error())
+	os.Exit(lib.ExitError)
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	URL "net/url"
@@ -13,6 +14,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"twmd/lib"
 
 	"github.com/andlabs/ui"
 	_ "github.com/andlabs/ui/winmanifest"
@@ -59,12 +61,23 @@ var (
 
 var download_id = make(chan string)
 
-func LogErr(err string) {
+// Logger is shared by the downloads below. In the GUI its records are
+// appended to the Log entry, otherwise they go to stderr.
+var Logger = lib.NewLogger(logWriter{}, slog.LevelInfo, false)
+
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	if !GUI || Log == nil {
+		return os.Stderr.Write(p)
+	}
+	line := string(p)
 	mu.Lock()
 	ui.QueueMain(func() {
-		Log.Append(err + "\n")
+		Log.Append(line)
 	})
 	mu.Unlock()
+	return len(p), nil
 }
 
 func Name(s string) string {
@@ -102,7 +115,7 @@ func UserTDownload(opt Opts) {
 		}
 
 		if tweet.Error != nil {
-			fmt.Println(tweet.Error)
+			Logger.Error("scraping failed", "user", opt.Username, "error", tweet.Error)
 			return
 		}
 		if opt.Media == "videos" || opt.Media == "all" {
@@ -113,7 +126,7 @@ func UserTDownload(opt Opts) {
 		}
 	}
 	wg.Wait()
-	fmt.Printf("Download %d tweet from %s", opt.Nbr, opt.Username)
+	Logger.Info("user download finished", "user", opt.Username, "tweets", opt.Nbr)
 	time.Sleep(1 * time.Second)
 }
 
@@ -200,7 +213,7 @@ func SingleTDownload(wg *sync.WaitGroup, opt Opts, rt bool, batch bool) {
 	scraper.SetProxy(opt.Proxy)
 	tweet, err := scraper.GetTweet(opt.Tweet_id)
 	if err != nil {
-		LogErr("Scrap: " + err.Error())
+		Logger.Error("scraping failed", "tweet_id", opt.Tweet_id, "error", err)
 		return
 	}
 
@@ -274,9 +287,8 @@ func SingleTDownload(wg *sync.WaitGroup, opt Opts, rt bool, batch bool) {
 	}()
 	gwg.Wait()
 	if GUI && !rt && !batch {
-		fmt.Print("wait")
 		wg.Wait()
-		fmt.Print("Done")
+		Logger.Debug("tweet download finished", "tweet_id", opt.Tweet_id)
 		mu.Lock()
 		ui.QueueMain(func() {
 			LogSingle.Append("--------------------------\n")
@@ -308,11 +320,7 @@ func download(wg *sync.WaitGroup, url string, output string, user string, gui bo
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		if gui {
-			LogErr("http: " + err.Error())
-		} else {
-			fmt.Println(err.Error())
-		}
+		Logger.Error("creating request failed", "url", url, "error", err)
 		return
 	}
 
@@ -347,17 +355,14 @@ func download(wg *sync.WaitGroup, url string, output string, user string, gui bo
 	hwg.Wait()
 
 	if http_err != nil {
-		if gui {
-			LogErr("http_err: " + http_err.Error())
-		} else {
-			fmt.Println(err.Error())
-		}
+		Logger.Error("download failed", "url", url, "error", http_err)
 		return
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
+		Logger.Warn("download failed", "url", url, "status", resp.StatusCode)
 		return
 	}
 	var f *os.File
@@ -369,11 +374,7 @@ func download(wg *sync.WaitGroup, url string, output string, user string, gui bo
 		f, ferr = os.Create(output + "/" + name)
 	}
 	if ferr != nil {
-		if gui {
-			LogErr("file: " + ferr.Error())
-		} else {
-			fmt.Println(err.Error())
-		}
+		Logger.Error("creating file failed", "url", url, "file", name, "error", ferr)
 		return
 	}
 	var cerr error
@@ -404,13 +405,8 @@ func download(wg *sync.WaitGroup, url string, output string, user string, gui bo
 	cwg.Wait()
 
 	if cerr != nil {
-		if gui {
-			LogErr("Copy: " + cerr.Error())
-			return
-		} else {
-			fmt.Println("Copy: " + cerr.Error())
-			return
-		}
+		Logger.Error("writing file failed", "url", url, "file", name, "error", cerr)
+		return
 	}
-	fmt.Println("Download: ", name)
+	Logger.Info("downloaded", "url", url, "file", name)
 }